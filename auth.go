@@ -0,0 +1,70 @@
+package sersan
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Login sets the auth ID of the request's session. The session ID is rotated when
+// the session is saved, preventing session fixation attacks.
+func Login(r *http.Request, authID string) error {
+	if authID == "" {
+		return errors.New("sersan: can't login with an empty auth ID")
+	}
+
+	sc, err := getSessionContext(r)
+	if err != nil {
+		return err
+	}
+
+	sc.data[sc.ss.AuthKey] = authID
+	forceInvalidate(sc.data, CurrentSessionID)
+	return nil
+}
+
+// Logout removes the auth ID from the request's session and rotates the session
+// ID. The rest of the session data is kept.
+func Logout(r *http.Request) error {
+	sc, err := getSessionContext(r)
+	if err != nil {
+		return err
+	}
+
+	delete(sc.data, sc.ss.AuthKey)
+	forceInvalidate(sc.data, CurrentSessionID)
+	return nil
+}
+
+// RotateID gives the request's session a new session ID when it's saved, keeping
+// its data.
+func RotateID(r *http.Request) error {
+	sc, err := getSessionContext(r)
+	if err != nil {
+		return err
+	}
+
+	forceInvalidate(sc.data, CurrentSessionID)
+	return nil
+}
+
+// LogoutEverywhere logs out the user of the request's session, and destroys all the
+// other sessions of that user.
+func LogoutEverywhere(r *http.Request) error {
+	sc, err := getSessionContext(r)
+	if err != nil {
+		return err
+	}
+
+	delete(sc.data, sc.ss.AuthKey)
+	forceInvalidate(sc.data, AllSessionIDsOfLoggedUser)
+	return nil
+}
+
+// Set the force invalidate key, without overriding a stronger invalidation already
+// requested.
+func forceInvalidate(data map[interface{}]interface{}, force ForceInvalidate) {
+	if v, ok := data[ForceInvalidateKey]; ok && v == AllSessionIDsOfLoggedUser {
+		return
+	}
+	data[ForceInvalidateKey] = force
+}
@@ -0,0 +1,202 @@
+package sersan
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func prepareAuthSessions() (*StorageRecorder, *ServerSessionState, []*Session) {
+	now := time.Now().UTC()
+	sessions := []*Session{
+		NewSession("session-1", "john", now),
+		NewSession("session-2", "john", now),
+		NewSession("session-3", "jane", now),
+		NewSession("session-4", "", now),
+	}
+	for _, sess := range sessions {
+		sess.Values["foo"] = "bar"
+	}
+	storage := PrepareStorageRecorder(sessions)
+	return storage, NewServerSessionState(storage), sessions
+}
+
+func TestLogin(t *testing.T) {
+	storage, ss, sessions := prepareAuthSessions()
+
+	data, token, _ := ss.Load(sessions[3].ID)
+	r := requestWithSessionState(ss, data)
+	if err := Login(r, ""); err == nil {
+		t.Fatal("expected Login with empty auth ID to fail")
+	}
+	if err := Login(r, "jane"); err != nil {
+		t.Fatalf("Login returned error: %v", err)
+	}
+	storage.GetOperations()
+
+	sess, err := ss.Save(token, data)
+	if err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	if sess.AuthID != "jane" || sess.ID == sessions[3].ID || sess.Values["foo"] != "bar" {
+		t.Fatal("expected logged in session with a new ID and the same values")
+	}
+	if op := storage.GetOperations(); !reflect.DeepEqual(op, []*RecorderOperation{
+		&RecorderOperation{Tag: "Destroy", ID: sessions[3].ID},
+		&RecorderOperation{Tag: "Insert", Session: sess},
+	}) {
+		t.Fatal("expected operations Destroy, Insert")
+	}
+}
+
+func TestLogout(t *testing.T) {
+	storage, ss, sessions := prepareAuthSessions()
+
+	data, token, _ := ss.Load(sessions[0].ID)
+	if err := Logout(requestWithSessionState(ss, data)); err != nil {
+		t.Fatalf("Logout returned error: %v", err)
+	}
+	storage.GetOperations()
+
+	sess, err := ss.Save(token, data)
+	if err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	if sess.AuthID != "" || sess.ID == sessions[0].ID {
+		t.Fatal("expected logged out session with a new ID")
+	}
+	if op := storage.GetOperations(); !reflect.DeepEqual(op, []*RecorderOperation{
+		&RecorderOperation{Tag: "Destroy", ID: sessions[0].ID},
+		&RecorderOperation{Tag: "Insert", Session: sess},
+	}) {
+		t.Fatal("expected operations Destroy, Insert")
+	}
+}
+
+func TestRotateID(t *testing.T) {
+	storage, ss, sessions := prepareAuthSessions()
+
+	data, token, _ := ss.Load(sessions[0].ID)
+	if err := RotateID(requestWithSessionState(ss, data)); err != nil {
+		t.Fatalf("RotateID returned error: %v", err)
+	}
+	storage.GetOperations()
+
+	sess, err := ss.Save(token, data)
+	if err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	if sess.AuthID != "john" || sess.ID == sessions[0].ID || sess.Values["foo"] != "bar" {
+		t.Fatal("expected session with a new ID and the same auth ID and values")
+	}
+	if gsess, _ := storage.Get(sessions[1].ID); gsess == nil {
+		t.Fatal("RotateID must not destroy the other sessions of the user")
+	}
+}
+
+func TestLogoutEverywhere(t *testing.T) {
+	storage, ss, sessions := prepareAuthSessions()
+
+	data, token, _ := ss.Load(sessions[0].ID)
+	r := requestWithSessionState(ss, data)
+	// logging out everywhere isn't downgraded by later calls
+	if err := LogoutEverywhere(r); err != nil {
+		t.Fatalf("LogoutEverywhere returned error: %v", err)
+	}
+	RotateID(r)
+	storage.GetOperations()
+
+	sess, err := ss.Save(token, data)
+	if err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	if sess.AuthID != "" || sess.ID == sessions[0].ID {
+		t.Fatal("expected logged out session with a new ID")
+	}
+	if op := storage.GetOperations(); !reflect.DeepEqual(op, []*RecorderOperation{
+		&RecorderOperation{Tag: "Destroy", ID: sessions[0].ID},
+		&RecorderOperation{Tag: "DestroyAllOfAuthId", AuthID: "john"},
+		&RecorderOperation{Tag: "Insert", Session: sess},
+	}) {
+		t.Fatal("expected operations Destroy, DestroyAllOfAuthId, Insert")
+	}
+	if gsess, _ := storage.Get(sessions[2].ID); gsess == nil {
+		t.Fatal("LogoutEverywhere must not destroy the sessions of other users")
+	}
+
+	// anonymous session, there are no other sessions to destroy
+	data, token, _ = ss.Load(sessions[3].ID)
+	LogoutEverywhere(requestWithSessionState(ss, data))
+	storage.GetOperations()
+	if _, err = ss.Save(token, data); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	for _, op := range storage.GetOperations() {
+		if op.Tag == "DestroyAllOfAuthId" {
+			t.Fatal("DestroyAllOfAuthId must not be called for anonymous session")
+		}
+	}
+}
+
+func TestLoginInvalidatingOtherSessions(t *testing.T) {
+	storage, ss, sessions := prepareAuthSessions()
+
+	// john logs in as jane, destroying the other sessions of john
+	data, token, _ := ss.Load(sessions[0].ID)
+	data[ss.AuthKey] = "jane"
+	data[ForceInvalidateKey] = AllSessionIDsOfLoggedUser
+	storage.GetOperations()
+
+	sess, err := ss.Save(token, data)
+	if err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	if sess.AuthID != "jane" || sess.ID == sessions[0].ID {
+		t.Fatal("expected session logged in as jane with a new ID")
+	}
+	if op := storage.GetOperations(); !reflect.DeepEqual(op, []*RecorderOperation{
+		&RecorderOperation{Tag: "Destroy", ID: sessions[0].ID},
+		&RecorderOperation{Tag: "DestroyAllOfAuthId", AuthID: "john"},
+		&RecorderOperation{Tag: "Insert", Session: sess},
+	}) {
+		t.Fatal("expected operations Destroy, DestroyAllOfAuthId, Insert")
+	}
+	if gsess, _ := storage.Get(sessions[1].ID); gsess != nil {
+		t.Fatal("expected the other sessions of john to be destroyed")
+	}
+	if gsess, _ := storage.Get(sessions[2].ID); gsess == nil {
+		t.Fatal("the sessions of jane must not be destroyed")
+	}
+}
+
+func TestSaveInvalidAuthValues(t *testing.T) {
+	storage, ss, sessions := prepareAuthSessions()
+
+	for _, data := range []map[interface{}]interface{}{
+		{ss.AuthKey: 42},
+		{ForceInvalidateKey: 3},
+		{ForceInvalidateKey: ForceInvalidate(2)},
+	} {
+		_, token, _ := ss.Load(sessions[0].ID)
+		expected := copyMap(data)
+		storage.GetOperations()
+
+		if _, err := ss.Save(token, data); err == nil {
+			t.Fatalf("expected Save to fail for invalid session data %v", data)
+		}
+		if op := storage.GetOperations(); len(op) != 0 {
+			t.Fatal("expected no storage operation for invalid session data")
+		}
+		if !reflect.DeepEqual(data, expected) {
+			t.Fatal("invalid session data must not be modified")
+		}
+	}
+}
+
+func TestAuthHelpersWithoutSession(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://localhost:8080/", nil)
+	if Login(r, "john") == nil || Logout(r) == nil || RotateID(r) == nil || LogoutEverywhere(r) == nil {
+		t.Fatal("expected helpers to fail without session middleware")
+	}
+}
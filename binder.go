@@ -0,0 +1,104 @@
+package sersan
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net"
+	"net/http"
+)
+
+// Binder binds sessions to attributes of the client which created them, making a
+// stolen session cookie useless from another client. The binding returned by Bind
+// is saved with the session, and must be at most 255 bytes long.
+//
+// Stricter bindings detect more hijacking attempts, but also reject legitimate
+// clients whose attributes changed, e.g. a browser update or a mobile client
+// switching networks. These clients get a new session.
+type Binder interface {
+	// Bind returns the binding of the client which sent the request.
+	Bind(r *http.Request) string
+	// Verify reports whether the client which sent the request matches the binding.
+	Verify(r *http.Request, binding string) bool
+}
+
+func verifyBinding(binder Binder, r *http.Request, binding string) bool {
+	return subtle.ConstantTimeCompare([]byte(binder.Bind(r)), []byte(binding)) == 1
+}
+
+func hashBinding(prefix string, b []byte) string {
+	sum := sha256.Sum256(b)
+	return prefix + hex.EncodeToString(sum[:])
+}
+
+// UserAgentBinder binds sessions to a hash of the client's User-Agent header. It's
+// trivial to forge, but it's cheap and stops the naive replay of a cookie from
+// another browser.
+type UserAgentBinder struct{}
+
+func (b UserAgentBinder) Bind(r *http.Request) string {
+	return hashBinding("ua:", []byte(r.UserAgent()))
+}
+
+func (b UserAgentBinder) Verify(r *http.Request, binding string) bool {
+	return verifyBinding(b, r, binding)
+}
+
+// IPPrefixBinder binds sessions to the network of the client's IP address, so
+// clients moving within their network keep their session.
+type IPPrefixBinder struct {
+	// Length of the network prefix for IPv4 and IPv6 addresses, 24 and 64 if zero.
+	IPv4PrefixLen, IPv6PrefixLen int
+	// IPExtractor returns the client's IP address, RemoteAddrIP if nil.
+	IPExtractor IPExtractor
+}
+
+func (b IPPrefixBinder) Bind(r *http.Request) string {
+	var addr string
+	if b.IPExtractor != nil {
+		addr = b.IPExtractor(r)
+	} else {
+		addr = RemoteAddrIP(r)
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return hashBinding("ip:", []byte(addr))
+	}
+
+	var mask net.IPMask
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		mask = net.CIDRMask(prefixLen(b.IPv4PrefixLen, 24), 8*net.IPv4len)
+	} else {
+		mask = net.CIDRMask(prefixLen(b.IPv6PrefixLen, 64), 8*net.IPv6len)
+	}
+
+	return "ip:" + (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
+
+func (b IPPrefixBinder) Verify(r *http.Request, binding string) bool {
+	return verifyBinding(b, r, binding)
+}
+
+func prefixLen(n, def int) int {
+	if n == 0 {
+		return def
+	}
+	return n
+}
+
+// ClientCertBinder binds sessions to the TLS client certificate used by the client.
+// Sessions created without client certificate can only be used without one.
+type ClientCertBinder struct{}
+
+func (b ClientCertBinder) Bind(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return "cert:none"
+	}
+	return hashBinding("cert:", r.TLS.PeerCertificates[0].Raw)
+}
+
+func (b ClientCertBinder) Verify(r *http.Request, binding string) bool {
+	return verifyBinding(b, r, binding)
+}
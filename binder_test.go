@@ -0,0 +1,151 @@
+package sersan
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newBinderRequest(remoteAddr, userAgent string) *http.Request {
+	r := httptest.NewRequest("GET", "http://localhost:8080/", nil)
+	r.RemoteAddr = remoteAddr
+	r.Header.Set("User-Agent", userAgent)
+	return r
+}
+
+func TestUserAgentBinder(t *testing.T) {
+	b := UserAgentBinder{}
+	binding := b.Bind(newBinderRequest("192.0.2.1:1234", "agent"))
+
+	if !strings.HasPrefix(binding, "ua:") || strings.Contains(binding, "agent") {
+		t.Fatalf("expected hashed user agent binding, got %s", binding)
+	}
+	if !b.Verify(newBinderRequest("198.51.100.1:1234", "agent"), binding) {
+		t.Fatal("expected binding to match the same user agent")
+	}
+	if b.Verify(newBinderRequest("192.0.2.1:1234", "other"), binding) {
+		t.Fatal("expected binding not to match another user agent")
+	}
+}
+
+func TestIPPrefixBinder(t *testing.T) {
+	b := IPPrefixBinder{}
+	tests := []struct {
+		bindAddr, verifyAddr string
+		match                bool
+	}{
+		{"192.0.2.1:1234", "192.0.2.200:4321", true},
+		{"192.0.2.1:1234", "192.0.3.1:1234", false},
+		{"[2001:db8:0:1::1]:1234", "[2001:db8:0:1::2]:1234", true},
+		{"[2001:db8:0:1::1]:1234", "[2001:db8:0:2::1]:1234", false},
+	}
+
+	for _, test := range tests {
+		binding := b.Bind(newBinderRequest(test.bindAddr, ""))
+		if b.Verify(newBinderRequest(test.verifyAddr, ""), binding) != test.match {
+			t.Errorf("expected binding %s of %s to match %s: %v", binding, test.bindAddr, test.verifyAddr, test.match)
+		}
+	}
+
+	strict := IPPrefixBinder{IPv4PrefixLen: 32}
+	if strict.Verify(newBinderRequest("192.0.2.2:1234", ""), strict.Bind(newBinderRequest("192.0.2.1:1234", ""))) {
+		t.Fatal("expected /32 binding not to match another address")
+	}
+}
+
+func TestClientCertBinder(t *testing.T) {
+	b := ClientCertBinder{}
+	plain := newBinderRequest("192.0.2.1:1234", "")
+	withCert := func(raw string) *http.Request {
+		r := newBinderRequest("192.0.2.1:1234", "")
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Raw: []byte(raw)}}}
+		return r
+	}
+
+	binding := b.Bind(withCert("cert-1"))
+	if !b.Verify(withCert("cert-1"), binding) {
+		t.Fatal("expected binding to match the same certificate")
+	}
+	if b.Verify(withCert("cert-2"), binding) || b.Verify(plain, binding) {
+		t.Fatal("expected binding not to match another certificate")
+	}
+	if b.Verify(withCert("cert-1"), b.Bind(plain)) {
+		t.Fatal("expected binding without certificate not to match a certificate")
+	}
+}
+
+func TestLoadRequestBinding(t *testing.T) {
+	storage := NewStorageRecorder()
+	ss := NewServerSessionState(storage)
+	ss.Binder = UserAgentBinder{}
+
+	// new session is bound to its client
+	data, token, _ := ss.LoadRequest(newBinderRequest("192.0.2.1:1234", "agent"), "")
+	data["foo"] = "bar"
+	sess, err := ss.Save(token, data)
+	if err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	if sess.Binding != ss.Binder.Bind(newBinderRequest("192.0.2.1:1234", "agent")) {
+		t.Fatal("expected new session to be bound to its client")
+	}
+
+	data, token, _ = ss.LoadRequest(newBinderRequest("192.0.2.1:1234", "agent"), sess.ID)
+	if token.sess == nil || data["foo"] != "bar" {
+		t.Fatal("expected session to be loaded by the client it's bound to")
+	}
+
+	// another client
+	data, token, _ = ss.LoadRequest(newBinderRequest("192.0.2.1:1234", "other"), sess.ID)
+	if token.sess != nil || len(data) != 0 {
+		t.Fatal("expected session bound to another client to be treated as missing")
+	}
+	if gsess, _ := storage.Get(sess.ID); gsess == nil {
+		t.Fatal("session bound to another client must not be destroyed")
+	}
+
+	// the callback accepts the session
+	var mismatched *Session
+	ss.OnBindingMismatch = func(r *http.Request, sess *Session) bool {
+		mismatched = sess
+		return true
+	}
+	data, token, _ = ss.LoadRequest(newBinderRequest("192.0.2.1:1234", "other"), sess.ID)
+	if mismatched == nil || mismatched.ID != sess.ID {
+		t.Fatal("expected OnBindingMismatch to be called with the session")
+	}
+	if token.sess == nil || data["foo"] != "bar" {
+		t.Fatal("expected session to be loaded when OnBindingMismatch accepts it")
+	}
+
+	// Load doesn't have the request, the binding can't be verified
+	if _, token, _ = ss.Load(sess.ID); token.sess == nil {
+		t.Fatal("expected Load to ignore the binding")
+	}
+}
+
+func TestBindUnboundSession(t *testing.T) {
+	sess := NewSession("session-1", "", time.Now().UTC())
+	sess.Values["foo"] = "bar"
+	storage := PrepareStorageRecorder([]*Session{sess})
+	ss := NewServerSessionState(storage)
+	ss.Binder = UserAgentBinder{}
+
+	r := newBinderRequest("192.0.2.1:1234", "agent")
+	data, token, _ := ss.LoadRequest(r, sess.ID)
+	storage.GetOperations()
+	nsess, err := ss.Save(token, data)
+	if err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	if op := storage.GetOperations(); len(op) != 1 || op[0].Tag != "Replace" {
+		t.Fatal("expected unbound session to be replaced")
+	}
+	if nsess.ID != sess.ID || nsess.Binding != ss.Binder.Bind(r) {
+		t.Fatal("expected unbound session to be bound to the current client")
+	}
+}
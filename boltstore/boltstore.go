@@ -0,0 +1,337 @@
+package boltstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/syaiful6/sersan"
+)
+
+var (
+	// session ID -> encoded sessionRecord
+	sessionsBucket = []byte("sersan_sessions")
+	// auth ID -> nested bucket of session IDs
+	authBucket = []byte("sersan_auth")
+	// big endian expiration time in unix nano + session ID -> nothing
+	expiryBucket = []byte("sersan_expiry")
+)
+
+// BoltStore implements sersan.Storage using bbolt, an embedded key/value database,
+// so the sessions survive restarts without running any external service.
+//
+// Besides the sessions, it keeps a bucket indexing sessions by auth ID for
+// DestroyAllOfAuthId and a bucket ordered by expiration time, so Prune only visits
+// the expired sessions.
+type BoltStore struct {
+	DB                           *bolt.DB
+	IdleTimeout, AbsoluteTimeout int
+	serializer                   sersan.SessionSerializer
+}
+
+type sessionRecord struct {
+	AuthID     string
+	Values     []byte
+	CreatedAt  time.Time
+	AccessedAt time.Time
+	// zero if the session never expires
+	ExpireAt time.Time
+	Metadata sersan.Metadata
+	Binding  string
+}
+
+// NewBoltStore instantiates a BoltStore with the provided database, creating the
+// buckets it needs.
+func NewBoltStore(db *bolt.DB) (*BoltStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{sessionsBucket, authBucket, expiryBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &BoltStore{
+		DB:              db,
+		IdleTimeout:     604800,  // 7 days
+		AbsoluteTimeout: 5184000, // 60 days
+		serializer:      sersan.GobSerializer{},
+	}, nil
+}
+
+func (bs *BoltStore) SetSerializer(serializer sersan.SessionSerializer) {
+	bs.serializer = serializer
+}
+
+func (bs *BoltStore) Get(id string) (*sersan.Session, error) {
+	var rec *sessionRecord
+
+	err := bs.DB.View(func(tx *bolt.Tx) error {
+		var err error
+		rec, err = getRecord(tx, id)
+		return err
+	})
+	if err != nil || rec == nil || rec.isExpired(time.Now().UTC()) {
+		return nil, err
+	}
+
+	sess := sersan.NewSession(id, rec.AuthID, rec.CreatedAt)
+	sess.AccessedAt = rec.AccessedAt
+	sess.Metadata = rec.Metadata
+	sess.Binding = rec.Binding
+	if err = bs.serializer.Deserialize(rec.Values, sess); err != nil {
+		return nil, err
+	}
+
+	return sess, nil
+}
+
+func (bs *BoltStore) Destroy(id string) error {
+	return bs.DB.Update(func(tx *bolt.Tx) error {
+		rec, err := getRecord(tx, id)
+		if err != nil || rec == nil {
+			return err
+		}
+		return deleteRecord(tx, id, rec)
+	})
+}
+
+func (bs *BoltStore) DestroyAllOfAuthId(authId string) error {
+	if authId == "" {
+		return nil
+	}
+
+	return bs.DB.Update(func(tx *bolt.Tx) error {
+		ab := tx.Bucket(authBucket).Bucket([]byte(authId))
+		if ab == nil {
+			return nil
+		}
+
+		var ids []string
+		err := ab.ForEach(func(k, _ []byte) error {
+			ids = append(ids, string(k))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			rec, err := getRecord(tx, id)
+			if err != nil {
+				return err
+			}
+			if rec != nil && rec.AuthID == authId {
+				if err = deleteRecord(tx, id, rec); err != nil {
+					return err
+				}
+			}
+		}
+
+		// deleteRecord already removed the index entries, but the bucket may
+		// still exist.
+		if err = tx.Bucket(authBucket).DeleteBucket([]byte(authId)); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		return nil
+	})
+}
+
+func (bs *BoltStore) Insert(sess *sersan.Session) error {
+	rec, err := bs.newRecord(sess)
+	if err != nil {
+		return err
+	}
+
+	return bs.DB.Update(func(tx *bolt.Tx) error {
+		old, err := getRecord(tx, sess.ID)
+		if err != nil {
+			return err
+		}
+		if old != nil {
+			if !old.isExpired(time.Now().UTC()) {
+				return sersan.SessionAlreadyExists{ID: sess.ID}
+			}
+			if err = deleteRecord(tx, sess.ID, old); err != nil {
+				return err
+			}
+		}
+
+		return putRecord(tx, sess.ID, rec)
+	})
+}
+
+func (bs *BoltStore) Replace(sess *sersan.Session) error {
+	rec, err := bs.newRecord(sess)
+	if err != nil {
+		return err
+	}
+
+	return bs.DB.Update(func(tx *bolt.Tx) error {
+		old, err := getRecord(tx, sess.ID)
+		if err != nil {
+			return err
+		}
+		if old == nil || old.isExpired(time.Now().UTC()) {
+			return sersan.SessionDoesNotExist{ID: sess.ID}
+		}
+
+		if err = deleteRecord(tx, sess.ID, old); err != nil {
+			return err
+		}
+		return putRecord(tx, sess.ID, rec)
+	})
+}
+
+// Prune deletes the expired sessions, in order of their expiration time. It returns
+// the number of deleted sessions.
+func (bs *BoltStore) Prune() (int, error) {
+	var (
+		n   int
+		now = time.Now().UTC()
+	)
+
+	err := bs.DB.Update(func(tx *bolt.Tx) error {
+		var expired [][]byte
+
+		c := tx.Bucket(expiryBucket).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if int64(binary.BigEndian.Uint64(k[:8])) > now.UnixNano() {
+				break
+			}
+			expired = append(expired, append([]byte(nil), k...))
+		}
+
+		for _, k := range expired {
+			id := string(k[8:])
+			rec, err := getRecord(tx, id)
+			if err != nil {
+				return err
+			}
+			// stale index entry, the session is gone or has been rewritten
+			if rec == nil || !bytes.Equal(expiryKey(rec.ExpireAt, id), k) {
+				if err = tx.Bucket(expiryBucket).Delete(k); err != nil {
+					return err
+				}
+				continue
+			}
+			if err = deleteRecord(tx, id, rec); err != nil {
+				return err
+			}
+			n++
+		}
+
+		return nil
+	})
+
+	return n, err
+}
+
+func (bs *BoltStore) newRecord(sess *sersan.Session) (*sessionRecord, error) {
+	values, err := bs.serializer.Serialize(sess)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sessionRecord{
+		AuthID:     sess.AuthID,
+		Values:     values,
+		CreatedAt:  sess.CreatedAt,
+		AccessedAt: sess.AccessedAt,
+		ExpireAt:   sess.ExpireAt(bs.IdleTimeout, bs.AbsoluteTimeout),
+		Metadata:   sess.Metadata,
+		Binding:    sess.Binding,
+	}, nil
+}
+
+func (rec *sessionRecord) isExpired(now time.Time) bool {
+	return !rec.ExpireAt.IsZero() && !rec.ExpireAt.After(now)
+}
+
+func getRecord(tx *bolt.Tx, id string) (*sessionRecord, error) {
+	data := tx.Bucket(sessionsBucket).Get([]byte(id))
+	if data == nil {
+		return nil, nil
+	}
+
+	rec := new(sessionRecord)
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(rec); err != nil {
+		return nil, err
+	}
+
+	return rec, nil
+}
+
+func putRecord(tx *bolt.Tx, id string, rec *sessionRecord) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(rec); err != nil {
+		return err
+	}
+
+	if err := tx.Bucket(sessionsBucket).Put([]byte(id), buf.Bytes()); err != nil {
+		return err
+	}
+
+	if rec.AuthID != "" {
+		ab, err := tx.Bucket(authBucket).CreateBucketIfNotExists([]byte(rec.AuthID))
+		if err != nil {
+			return err
+		}
+		if err = ab.Put([]byte(id), []byte{}); err != nil {
+			return err
+		}
+	}
+
+	if !rec.ExpireAt.IsZero() {
+		return tx.Bucket(expiryBucket).Put(expiryKey(rec.ExpireAt, id), []byte{})
+	}
+
+	return nil
+}
+
+// deleteRecord removes the session and its index entries.
+func deleteRecord(tx *bolt.Tx, id string, rec *sessionRecord) error {
+	if err := tx.Bucket(sessionsBucket).Delete([]byte(id)); err != nil {
+		return err
+	}
+
+	if rec.AuthID != "" {
+		if ab := tx.Bucket(authBucket).Bucket([]byte(rec.AuthID)); ab != nil {
+			if err := ab.Delete([]byte(id)); err != nil {
+				return err
+			}
+			if k, _ := ab.Cursor().First(); k == nil {
+				if err := tx.Bucket(authBucket).DeleteBucket([]byte(rec.AuthID)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if !rec.ExpireAt.IsZero() {
+		return tx.Bucket(expiryBucket).Delete(expiryKey(rec.ExpireAt, id))
+	}
+
+	return nil
+}
+
+// Expiration times before 1970 are clamped to 0, so they sort first instead of
+// wrapping around to the end of the index.
+func expiryKey(t time.Time, id string) []byte {
+	var ns uint64
+	if t.After(time.Unix(0, 0)) {
+		ns = uint64(t.UnixNano())
+	}
+
+	k := make([]byte, 8+len(id))
+	binary.BigEndian.PutUint64(k, ns)
+	copy(k[8:], id)
+	return k
+}
@@ -0,0 +1,128 @@
+package boltstore
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/syaiful6/sersan"
+	"github.com/syaiful6/sersan/storagetest"
+)
+
+func createBoltStore(t *testing.T) *BoltStore {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "sessions.db"), 0600, nil)
+	if err != nil {
+		t.Fatalf("can't open bolt database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	bs, err := NewBoltStore(db)
+	if err != nil {
+		t.Fatalf("can't create boltstore, returned %v", err)
+	}
+	return bs
+}
+
+func TestIndexBuckets(t *testing.T) {
+	bs := createBoltStore(t)
+	sess := storagetest.GenerateSession(true)
+	other := storagetest.GenerateSession(true)
+
+	for _, s := range []*sersan.Session{sess, other} {
+		if err := bs.Insert(s); err != nil {
+			t.Fatalf("Failed inserting session. return %v", err)
+		}
+	}
+	assertBucketLen(t, bs, authBucket, 2)
+	assertBucketLen(t, bs, expiryBucket, 2)
+
+	// logged out, the auth index is updated
+	if err := bs.Replace(storagetest.CloneSession(sess, "")); err != nil {
+		t.Fatalf("Replace returned error: %v", err)
+	}
+	assertBucketLen(t, bs, authBucket, 1)
+	assertBucketLen(t, bs, expiryBucket, 2)
+
+	if err := bs.DestroyAllOfAuthId(other.AuthID); err != nil {
+		t.Fatalf("DestroyAllOfAuthId returned error: %v", err)
+	}
+	if err := bs.Destroy(sess.ID); err != nil {
+		t.Fatalf("Failed removing session. return %v", err)
+	}
+	assertBucketLen(t, bs, sessionsBucket, 0)
+	assertBucketLen(t, bs, authBucket, 0)
+	assertBucketLen(t, bs, expiryBucket, 0)
+}
+
+func TestPrune(t *testing.T) {
+	bs := createBoltStore(t)
+	bs.IdleTimeout = 60
+
+	expired := storagetest.GenerateSession(true)
+	expired.AccessedAt = expired.AccessedAt.Add(-2 * time.Minute)
+	// expiring before 1970
+	zero := storagetest.GenerateSession(false)
+	zero.CreatedAt, zero.AccessedAt = time.Time{}, time.Time{}
+	fresh := storagetest.GenerateSession(true)
+
+	for _, sess := range []*sersan.Session{expired, zero, fresh} {
+		if err := bs.Insert(sess); err != nil {
+			t.Fatalf("Insert returned error: %v", err)
+		}
+	}
+
+	if gsess, _ := bs.Get(expired.ID); gsess != nil {
+		t.Fatal("expired session must not be returned by Get")
+	}
+
+	n, err := bs.Prune()
+	if err != nil {
+		t.Fatalf("Prune returned error: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("expected Prune to delete 2 sessions, deleted %d", n)
+	}
+	if gsess, _ := bs.Get(fresh.ID); gsess == nil {
+		t.Fatal("fresh session must not be deleted by Prune")
+	}
+	assertBucketLen(t, bs, sessionsBucket, 1)
+	assertBucketLen(t, bs, authBucket, 1)
+	assertBucketLen(t, bs, expiryBucket, 1)
+}
+
+func TestJSONSerializer(t *testing.T) {
+	bs := createBoltStore(t)
+	bs.SetSerializer(sersan.JSONSerializer{})
+
+	sess := storagetest.GenerateSession(false)
+	if err := bs.Insert(sess); err != nil {
+		t.Fatalf("Insert returned error: %v", err)
+	}
+	gsess, err := bs.Get(sess.ID)
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	storagetest.AssertSessionEqual(t, sess, gsess)
+}
+
+func assertBucketLen(t *testing.T, bs *BoltStore, name []byte, n int) {
+	bs.DB.View(func(tx *bolt.Tx) error {
+		var l int
+		c := tx.Bucket(name).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			l++
+		}
+		if l != n {
+			t.Fatalf("expected %d keys in bucket %s, got %d", n, name, l)
+		}
+		return nil
+	})
+}
+
+func TestStorageSuite(t *testing.T) {
+	storagetest.RunStorageSuite(t, func(t *testing.T) sersan.Storage {
+		return createBoltStore(t)
+	})
+}
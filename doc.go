@@ -3,9 +3,13 @@ Package sersan implement traditional server session. Users who don't have a sess
 yet are assigned a random 32byte session ID and encoded using base32. All session
 data is saved on a storage backend.
 
-This package includes 2 implementation of *Backend (storage)*. It includes:
+This package includes 6 implementation of *Backend (storage)*. It includes:
 
 * Redis: Storage backend for using *Redis* via [redigo](https://github.com/gomodule/redigo).
+* Memory: Storage backend keeping sessions in memory, for single instance deployments.
+* SQL: Storage backend for PostgreSQL, MySQL and SQLite via database/sql.
+* File: Storage backend saving each session as a file, handy for small deployments and debugging.
+* Bolt: Storage backend using the embedded [bbolt](https://github.com/etcd-io/bbolt) key/value database.
 * Recorder(testing): Storage backend for testing purpose.
 
 The API is simple. Here an example that shows the sersan API:
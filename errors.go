@@ -1,9 +1,14 @@
 package sersan
 
 import (
+	"errors"
 	"fmt"
 )
 
+// ErrNotSupported is returned when the storage doesn't implement the optional
+// extension needed by an operation.
+var ErrNotSupported = errors.New("sersan: operation not supported by the storage")
+
 type SessionAlreadyExists struct {
 	ID string
 }
@@ -12,6 +17,16 @@ func (err SessionAlreadyExists) Error() string {
 	return fmt.Sprintf("There is already exists a session with the same session ID: %s", err.ID)
 }
 
+// SessionVersionConflict is returned by VersionReplacer when the session was
+// replaced by someone else since it was loaded.
+type SessionVersionConflict struct {
+	ID string
+}
+
+func (err SessionVersionConflict) Error() string {
+	return fmt.Sprintf("The session was modified concurrently, session ID: %s", err.ID)
+}
+
 type SessionDoesNotExist struct {
 	ID string
 }
@@ -0,0 +1,457 @@
+package filestore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/syaiful6/sersan"
+)
+
+var sessionIDRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// How long an empty or undecodable file is kept before Sweep deletes it. Such
+// files are left behind by a process crashing while writing a session.
+const brokenFileGracePeriod = 10 * time.Minute
+
+// FileStore implements sersan.Storage saving each session as a JSON file under a
+// directory. The layout of the directory is:
+//
+//	sessions/<first 2 characters of session ID>/<session ID>
+//	auth/<sha256 of auth ID>/<session ID>
+//
+// The files under `auth` are empty, they're an index used by DestroyAllOfAuthId so
+// it doesn't need to scan every session. Writes are serialized within a single
+// FileStore, so only one FileStore (and process) should use a directory.
+type FileStore struct {
+	IdleTimeout, AbsoluteTimeout int
+	dir                          string
+	serializer                   sersan.SessionSerializer
+	mu                           sync.Mutex
+}
+
+// The content of session file.
+type sessionRecord struct {
+	AuthID     string    `json:"auth_id"`
+	Values     []byte    `json:"values"`
+	CreatedAt  time.Time `json:"created_at"`
+	AccessedAt time.Time `json:"accessed_at"`
+	IP         string    `json:"ip,omitempty"`
+	LastSeenIP string    `json:"last_seen_ip,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	Label      string    `json:"label,omitempty"`
+	Binding    string    `json:"binding,omitempty"`
+}
+
+// NewFileStore instantiates a FileStore saving the sessions under dir, the directory
+// is created if it doesn't exist.
+func NewFileStore(dir string) (*FileStore, error) {
+	fs := &FileStore{
+		IdleTimeout:     604800,  // 7 days
+		AbsoluteTimeout: 5184000, // 60 days
+		dir:             dir,
+		serializer:      sersan.GobSerializer{},
+	}
+
+	for _, d := range []string{fs.sessionsDir(), fs.authDir()} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	return fs, nil
+}
+
+func (fs *FileStore) SetSerializer(serializer sersan.SessionSerializer) {
+	fs.serializer = serializer
+}
+
+func (fs *FileStore) Get(id string) (*sersan.Session, error) {
+	if !sessionIDRegexp.MatchString(id) {
+		return nil, nil
+	}
+
+	rec, err := fs.readRecord(id)
+	if err != nil || rec == nil {
+		return nil, err
+	}
+
+	sess := rec.toSession(id)
+	if fs.isExpired(sess, time.Now().UTC()) {
+		return nil, nil
+	}
+	if err = fs.serializer.Deserialize(rec.Values, sess); err != nil {
+		return nil, err
+	}
+
+	return sess, nil
+}
+
+func (fs *FileStore) Destroy(id string) error {
+	if !sessionIDRegexp.MatchString(id) {
+		return nil
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.destroy(id)
+}
+
+func (fs *FileStore) DestroyAllOfAuthId(authId string) error {
+	if authId == "" {
+		return nil
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir := fs.authIndexDir(authId)
+	infos, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, info := range infos {
+		id := info.Name()
+		rec, err := fs.readRecord(id)
+		if err != nil {
+			return err
+		}
+		if rec != nil && rec.AuthID == authId {
+			if err = removeIfExists(fs.sessionPath(id)); err != nil {
+				return err
+			}
+		}
+		if err = removeIfExists(filepath.Join(dir, id)); err != nil {
+			return err
+		}
+	}
+
+	return removeIfExists(dir)
+}
+
+func (fs *FileStore) Insert(sess *sersan.Session) error {
+	if !sessionIDRegexp.MatchString(sess.ID) {
+		return fmt.Errorf("sersan/filestore: invalid session ID: %s", sess.ID)
+	}
+
+	data, err := fs.encode(sess)
+	if err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	path := fs.sessionPath(sess.ID)
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	// Reserve the session ID, then fill the content with an atomic rename so
+	// readers never see partially written file.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		if os.IsExist(err) {
+			return sersan.SessionAlreadyExists{ID: sess.ID}
+		}
+		return err
+	}
+	f.Close()
+
+	if err = writeFileAtomic(path, data); err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	return fs.index(sess.AuthID, sess.ID)
+}
+
+func (fs *FileStore) Replace(sess *sersan.Session) error {
+	if !sessionIDRegexp.MatchString(sess.ID) {
+		return sersan.SessionDoesNotExist{ID: sess.ID}
+	}
+
+	data, err := fs.encode(sess)
+	if err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	old, err := fs.readRecord(sess.ID)
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		return sersan.SessionDoesNotExist{ID: sess.ID}
+	}
+
+	if err = writeFileAtomic(fs.sessionPath(sess.ID), data); err != nil {
+		return err
+	}
+
+	if old.AuthID != sess.AuthID {
+		if err = fs.unindex(old.AuthID, sess.ID); err != nil {
+			return err
+		}
+		return fs.index(sess.AuthID, sess.ID)
+	}
+
+	return nil
+}
+
+// Sweep deletes the session files that are expired according to IdleTimeout and
+// AbsoluteTimeout, returns the number of deleted sessions. No session expires if
+// both timeouts are disabled. It also deletes the empty, undecodable or temporary
+// files left behind by interrupted writes, once they're older than a grace period.
+func (fs *FileStore) Sweep() (int, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	shards, err := os.ReadDir(fs.sessionsDir())
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		n   int
+		now = time.Now().UTC()
+	)
+	for _, shard := range shards {
+		if !shard.IsDir() {
+			continue
+		}
+		infos, err := os.ReadDir(filepath.Join(fs.sessionsDir(), shard.Name()))
+		if err != nil {
+			return n, err
+		}
+		for _, info := range infos {
+			id := info.Name()
+			path := filepath.Join(fs.sessionsDir(), shard.Name(), id)
+			if strings.HasPrefix(id, ".") {
+				if err = removeBroken(path, info, now); err != nil {
+					return n, err
+				}
+				continue
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return n, err
+			}
+			rec, err := decodeRecord(data)
+			if err != nil || rec == nil {
+				if err = removeBroken(path, info, now); err != nil {
+					return n, err
+				}
+				continue
+			}
+			if !fs.isExpired(rec.toSession(id), now) {
+				continue
+			}
+			if err = fs.destroy(id); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// destroy must be called with fs.mu held.
+func (fs *FileStore) destroy(id string) error {
+	rec, err := fs.readRecord(id)
+	if err != nil || rec == nil {
+		return err
+	}
+
+	if err = removeIfExists(fs.sessionPath(id)); err != nil {
+		return err
+	}
+
+	return fs.unindex(rec.AuthID, id)
+}
+
+func (fs *FileStore) index(authId, id string) error {
+	if authId == "" {
+		return nil
+	}
+
+	dir := fs.authIndexDir(authId)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dir, id), nil, 0600)
+}
+
+func (fs *FileStore) unindex(authId, id string) error {
+	if authId == "" {
+		return nil
+	}
+
+	dir := fs.authIndexDir(authId)
+	if err := removeIfExists(filepath.Join(dir, id)); err != nil {
+		return err
+	}
+
+	// only succeed if the directory is empty
+	os.Remove(dir)
+	return nil
+}
+
+// readRecord returns nil if the session file doesn't exist or it's not written yet.
+func (fs *FileStore) readRecord(id string) (*sessionRecord, error) {
+	data, err := os.ReadFile(fs.sessionPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return decodeRecord(data)
+}
+
+// decodeRecord returns nil for an empty file, the session is not written yet.
+func decodeRecord(data []byte) (*sessionRecord, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	rec := new(sessionRecord)
+	if err := json.Unmarshal(data, rec); err != nil {
+		return nil, err
+	}
+
+	return rec, nil
+}
+
+func (fs *FileStore) encode(sess *sersan.Session) ([]byte, error) {
+	values, err := fs.serializer.Serialize(sess)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&sessionRecord{
+		AuthID:     sess.AuthID,
+		Values:     values,
+		CreatedAt:  sess.CreatedAt,
+		AccessedAt: sess.AccessedAt,
+		IP:         sess.Metadata.IP,
+		LastSeenIP: sess.Metadata.LastSeenIP,
+		UserAgent:  sess.Metadata.UserAgent,
+		Label:      sess.Metadata.Label,
+		Binding:    sess.Binding,
+	})
+}
+
+func (fs *FileStore) isExpired(sess *sersan.Session, now time.Time) bool {
+	if fs.IdleTimeout == 0 && fs.AbsoluteTimeout == 0 {
+		return false
+	}
+	return sess.IsSessionExpired(fs.IdleTimeout, fs.AbsoluteTimeout, now)
+}
+
+func (fs *FileStore) sessionsDir() string {
+	return filepath.Join(fs.dir, "sessions")
+}
+
+func (fs *FileStore) authDir() string {
+	return filepath.Join(fs.dir, "auth")
+}
+
+func (fs *FileStore) sessionPath(id string) string {
+	shard := id
+	if len(id) > 2 {
+		shard = id[:2]
+	}
+	return filepath.Join(fs.sessionsDir(), shard, id)
+}
+
+func (fs *FileStore) authIndexDir(authId string) string {
+	sum := sha256.Sum256([]byte(authId))
+	return filepath.Join(fs.authDir(), hex.EncodeToString(sum[:]))
+}
+
+func (rec *sessionRecord) toSession(id string) *sersan.Session {
+	sess := sersan.NewSession(id, rec.AuthID, rec.CreatedAt)
+	sess.AccessedAt = rec.AccessedAt
+	sess.Metadata = sersan.Metadata{
+		IP:         rec.IP,
+		LastSeenIP: rec.LastSeenIP,
+		UserAgent:  rec.UserAgent,
+		Label:      rec.Label,
+	}
+	sess.Binding = rec.Binding
+	return sess
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory, then
+// rename it to path.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0600)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+
+	return err
+}
+
+// removeBroken deletes the file left behind by an interrupted write, if it's older
+// than brokenFileGracePeriod so a write in progress isn't disturbed.
+func removeBroken(path string, entry os.DirEntry, now time.Time) error {
+	info, err := entry.Info()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if now.Sub(info.ModTime()) < brokenFileGracePeriod {
+		return nil
+	}
+
+	return removeIfExists(path)
+}
+
+func removeIfExists(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
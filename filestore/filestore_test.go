@@ -0,0 +1,153 @@
+package filestore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/syaiful6/sersan"
+	"github.com/syaiful6/sersan/storagetest"
+)
+
+func createFileStore(t *testing.T) *FileStore {
+	fs, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("can't create filestore, returned %v", err)
+	}
+	return fs
+}
+
+func TestLayout(t *testing.T) {
+	fs := createFileStore(t)
+	sess := storagetest.GenerateSession(true)
+
+	if err := fs.Insert(sess); err != nil {
+		t.Fatalf("Failed inserting session. return %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(fs.dir, "sessions", sess.ID[:2], sess.ID)); err != nil {
+		t.Fatalf("expected session file to be sharded by ID prefix: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(fs.authIndexDir(sess.AuthID), sess.ID)); err != nil {
+		t.Fatalf("expected session to be in the auth index: %v", err)
+	}
+
+	moved := storagetest.CloneSession(sess, storagetest.GenerateSessionId())
+	if err := fs.Replace(moved); err != nil {
+		t.Fatalf("Replace returned error: %v", err)
+	}
+	if _, err := os.Stat(fs.authIndexDir(sess.AuthID)); !os.IsNotExist(err) {
+		t.Fatal("expected old auth index to be removed when auth ID changed")
+	}
+
+	if err := fs.Destroy(moved.ID); err != nil {
+		t.Fatalf("Failed removing session. return %v", err)
+	}
+	if _, err := os.Stat(fs.authIndexDir(moved.AuthID)); !os.IsNotExist(err) {
+		t.Fatal("expected auth index to be removed with the session")
+	}
+}
+
+func TestInvalidSessionID(t *testing.T) {
+	fs := createFileStore(t)
+
+	sess, err := fs.Get("../../etc/passwd")
+	if err != nil || sess != nil {
+		t.Fatal("expected both sess and err return nil for invalid session ID")
+	}
+
+	s := storagetest.GenerateSession(false)
+	s.ID = "../foo"
+	if err = fs.Insert(s); err == nil {
+		t.Fatal("expected Insert to reject invalid session ID")
+	}
+}
+
+func TestSweep(t *testing.T) {
+	fs := createFileStore(t)
+	fs.IdleTimeout = 60
+
+	expired := storagetest.GenerateSession(true)
+	expired.AccessedAt = expired.AccessedAt.Add(-2 * time.Minute)
+	fresh := storagetest.GenerateSession(true)
+
+	for _, sess := range []*sersan.Session{expired, fresh} {
+		if err := fs.Insert(sess); err != nil {
+			t.Fatalf("Insert returned error: %v", err)
+		}
+	}
+
+	if gsess, _ := fs.Get(expired.ID); gsess != nil {
+		t.Fatal("expired session must not be returned by Get")
+	}
+
+	n, err := fs.Sweep()
+	if err != nil {
+		t.Fatalf("Sweep returned error: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("expected Sweep to delete 1 session, deleted %d", n)
+	}
+	if _, err = os.Stat(fs.sessionPath(expired.ID)); !os.IsNotExist(err) {
+		t.Fatal("expected expired session file to be deleted")
+	}
+	if gsess, _ := fs.Get(fresh.ID); gsess == nil {
+		t.Fatal("fresh session must not be deleted by Sweep")
+	}
+}
+
+func TestSweepBrokenFiles(t *testing.T) {
+	fs := createFileStore(t)
+	old := time.Now().Add(-2 * brokenFileGracePeriod)
+
+	// files left behind by interrupted writes
+	empty := storagetest.GenerateSession(true)
+	garbage := storagetest.GenerateSession(true)
+	recent := storagetest.GenerateSession(true)
+	files := map[string][]byte{
+		fs.sessionPath(empty.ID):   nil,
+		fs.sessionPath(garbage.ID): []byte("{not json"),
+		filepath.Join(filepath.Dir(fs.sessionPath(empty.ID)), ".tmp-123"): []byte("{"),
+	}
+	for path, data := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatalf("MkdirAll returned error: %v", err)
+		}
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatalf("WriteFile returned error: %v", err)
+		}
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatalf("Chtimes returned error: %v", err)
+		}
+	}
+	// possibly a write in progress
+	recentPath := fs.sessionPath(recent.ID)
+	os.MkdirAll(filepath.Dir(recentPath), 0700)
+	if err := os.WriteFile(recentPath, nil, 0600); err != nil {
+		t.Fatalf("WriteFile returned error: %v", err)
+	}
+
+	if err := fs.Insert(empty); err != (sersan.SessionAlreadyExists{ID: empty.ID}) {
+		t.Fatalf("expected Insert to fail while the empty file exists, returned %v", err)
+	}
+	if _, err := fs.Sweep(); err != nil {
+		t.Fatalf("Sweep returned error: %v", err)
+	}
+	for path := range files {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("expected broken file %s to be deleted", path)
+		}
+	}
+	if _, err := os.Stat(recentPath); err != nil {
+		t.Fatal("files younger than the grace period must not be deleted")
+	}
+	if err := fs.Insert(empty); err != nil {
+		t.Fatalf("Insert returned error: %v", err)
+	}
+}
+
+func TestStorageSuite(t *testing.T) {
+	storagetest.RunStorageSuite(t, func(t *testing.T) sersan.Storage {
+		return createFileStore(t)
+	})
+}
@@ -0,0 +1,49 @@
+package sersan
+
+import (
+	"net/http"
+)
+
+// flash messages, as category and message pairs. A []string is used so
+// GobSerializer can encode them without registering a type.
+var flashKey = NewKey[[]string](FlashKey)
+
+// AddFlash adds a flash message to the given category. Flash messages are kept in
+// the session until they are read with Flashes, usually on the next request after
+// a redirect.
+func AddFlash(r *http.Request, category, msg string) error {
+	flashes, _ := flashKey.Get(r)
+	// don't modify the slice in place, so the change is noticed when saving
+	nflashes := append(flashes[:len(flashes):len(flashes)], category, msg)
+
+	return flashKey.Set(r, nflashes)
+}
+
+// Flashes returns the flash messages of the given category, and removes them
+// from the session.
+func Flashes(r *http.Request, category string) []string {
+	flashes, ok := flashKey.Get(r)
+	if !ok {
+		return nil
+	}
+
+	var msgs, nflashes []string
+	for i := 0; i+1 < len(flashes); i += 2 {
+		if flashes[i] == category {
+			msgs = append(msgs, flashes[i+1])
+		} else {
+			nflashes = append(nflashes, flashes[i], flashes[i+1])
+		}
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	if len(nflashes) == 0 {
+		flashKey.Delete(r)
+	} else {
+		flashKey.Set(r, nflashes)
+	}
+
+	return msgs
+}
@@ -0,0 +1,103 @@
+package sersan
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFlashes(t *testing.T) {
+	r := requestWithSession(make(map[interface{}]interface{}))
+
+	if msgs := Flashes(r, "info"); msgs != nil {
+		t.Fatalf("expected no flash messages, got %v", msgs)
+	}
+
+	AddFlash(r, "info", "saved")
+	AddFlash(r, "info", "sent")
+	AddFlash(r, "error", "failed")
+
+	if msgs := Flashes(r, "info"); !reflect.DeepEqual(msgs, []string{"saved", "sent"}) {
+		t.Fatalf("unexpected flash messages %v", msgs)
+	}
+	if msgs := Flashes(r, "info"); msgs != nil {
+		t.Fatalf("expected flash messages to be consumed, got %v", msgs)
+	}
+	if msgs := Flashes(r, "error"); !reflect.DeepEqual(msgs, []string{"failed"}) {
+		t.Fatalf("unexpected flash messages %v", msgs)
+	}
+
+	data, _ := GetSession(r)
+	if _, ok := data[FlashKey]; ok {
+		t.Fatal("expected flash key to be removed once all messages are consumed")
+	}
+}
+
+func TestFlashesSerializers(t *testing.T) {
+	for _, serializer := range []SessionSerializer{GobSerializer{}, JSONSerializer{}} {
+		r := requestWithSession(make(map[interface{}]interface{}))
+		AddFlash(r, "info", "saved")
+
+		data, _ := GetSession(r)
+		r = requestWithSession(roundTrip(t, serializer, data))
+
+		AddFlash(r, "info", "sent")
+		if msgs := Flashes(r, "info"); !reflect.DeepEqual(msgs, []string{"saved", "sent"}) {
+			t.Fatalf("unexpected flash messages %v", msgs)
+		}
+	}
+}
+
+func TestFlashesSurviveLogin(t *testing.T) {
+	now := time.Now().UTC()
+	sess := NewSession("123456789-123456789-123456789-12", "", now)
+	sess.Values[FlashKey] = []string{"info", "welcome"}
+	storage := PrepareStorageRecorder([]*Session{sess})
+	ss := NewServerSessionState(storage)
+
+	data, token, err := ss.Load(sess.ID)
+	if err != nil {
+		t.Fatalf("Load session failed with error: %v", err)
+	}
+	AddFlash(requestWithSession(data), "info", "logged in")
+	data[ss.AuthKey] = "john"
+
+	nsess, err := ss.Save(token, data)
+	if err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	if nsess.ID == sess.ID {
+		t.Fatal("expected session ID to be rotated on login")
+	}
+
+	data, _, err = ss.Load(nsess.ID)
+	if err != nil {
+		t.Fatalf("Load session failed with error: %v", err)
+	}
+	if msgs := Flashes(requestWithSession(data), "info"); !reflect.DeepEqual(msgs, []string{"welcome", "logged in"}) {
+		t.Fatalf("expected flash messages to survive login, got %v", msgs)
+	}
+}
+
+func TestFlashesMarkSessionModified(t *testing.T) {
+	now := time.Now().UTC()
+	sess := NewSession("123456789-123456789-123456789-12", "", now)
+	sess.Values[FlashKey] = []string{"info", "welcome"}
+	storage := PrepareStorageRecorder([]*Session{sess})
+	ss := NewServerSessionState(storage)
+
+	data, token, _ := ss.Load(sess.ID)
+	storage.GetOperations()
+	Flashes(requestWithSession(data), "info")
+
+	nsess, err := ss.Save(token, data)
+	if err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	if op := storage.GetOperations(); len(op) != 1 || op[0].Tag != "Replace" {
+		t.Fatal("expected session to be replaced after consuming flash messages")
+	}
+	if _, ok := nsess.Values[FlashKey]; ok {
+		t.Fatal("expected consumed flash messages to be removed from the session")
+	}
+}
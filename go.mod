@@ -1,6 +1,17 @@
 module github.com/syaiful6/sersan
 
+go 1.18
+
 require (
-	github.com/gomodule/redigo v2.0.0+incompatible
+	github.com/alicebob/miniredis/v2 v2.33.0
+	github.com/gomodule/redigo v1.8.9
 	github.com/gorilla/securecookie v1.1.1
+	github.com/mattn/go-sqlite3 v1.14.22
+	go.etcd.io/bbolt v1.3.6
+)
+
+require (
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
+	golang.org/x/sys v0.0.0-20200923182605-d9f96fdee20d // indirect
 )
@@ -0,0 +1,104 @@
+package sersan
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Key is a typed accessor for a session value, so handlers don't need to type
+// assert the values of the map returned by GetSession:
+//
+//	var countKey = sersan.NewKey[int]("count")
+//
+//	func handler(w http.ResponseWriter, r *http.Request) {
+//		count, _ := countKey.Get(r)
+//		countKey.Set(r, count+1)
+//	}
+//
+// Values decoded by JSONSerializer don't keep their Go types, numbers are decoded
+// as float64 and objects as map[string]interface{}. Key converts them back to T
+// by encoding them to JSON and decoding the result into T. With GobSerializer,
+// the types other than the basic ones must be registered with gob.Register.
+type Key[T any] struct {
+	name string
+}
+
+// NewKey returns a Key storing its value under the given name in the session.
+func NewKey[T any](name string) Key[T] {
+	return Key[T]{name: name}
+}
+
+// Name returns the name of the key in the session.
+func (k Key[T]) Name() string {
+	return k.name
+}
+
+// Get returns the value of the key in the request's session. The boolean is false
+// if the key is not set, there is no session, or the value can't be converted to T.
+func (k Key[T]) Get(r *http.Request) (T, bool) {
+	var zero T
+
+	data, err := GetSession(r)
+	if err != nil {
+		return zero, false
+	}
+	v, ok := data[k.name]
+	if !ok {
+		return zero, false
+	}
+
+	return convertValue[T](v)
+}
+
+// Set the value of the key in the request's session.
+func (k Key[T]) Set(r *http.Request, v T) error {
+	data, err := GetSession(r)
+	if err != nil {
+		return err
+	}
+	data[k.name] = v
+	return nil
+}
+
+// Delete removes the key from the request's session.
+func (k Key[T]) Delete(r *http.Request) error {
+	data, err := GetSession(r)
+	if err != nil {
+		return err
+	}
+	delete(data, k.name)
+	return nil
+}
+
+// Pop returns the value of the key like Get, and removes it from the session.
+func (k Key[T]) Pop(r *http.Request) (T, bool) {
+	v, ok := k.Get(r)
+	if ok {
+		k.Delete(r)
+	}
+	return v, ok
+}
+
+func convertValue[T any](v interface{}) (T, bool) {
+	var t T
+	if tv, ok := v.(T); ok {
+		return tv, true
+	}
+
+	// the value may have been decoded from JSON, and be represented differently.
+	// Values of other types don't match T.
+	switch v.(type) {
+	case float64, bool, string, []interface{}, map[string]interface{}:
+	default:
+		return t, false
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return t, false
+	}
+	if err = json.Unmarshal(b, &t); err != nil {
+		return t, false
+	}
+
+	return t, true
+}
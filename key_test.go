@@ -0,0 +1,166 @@
+package sersan
+
+import (
+	"context"
+	"encoding/gob"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type keyTestUser struct {
+	Name  string
+	Roles []string
+}
+
+func init() {
+	gob.Register(keyTestUser{})
+	gob.Register(map[string]int{})
+}
+
+func requestWithSession(data map[interface{}]interface{}) *http.Request {
+	return requestWithSessionState(NewServerSessionState(NewStorageRecorder()), data)
+}
+
+func requestWithSessionState(ss *ServerSessionState, data map[interface{}]interface{}) *http.Request {
+	r := httptest.NewRequest("GET", "http://localhost:8080/", nil)
+	return r.WithContext(context.WithValue(r.Context(), sessionContextKey{},
+		&sessionContext{data: data, token: &SaveSessionToken{}, ss: ss}))
+}
+
+// Returns the session values after being serialized and deserialized.
+func roundTrip(t *testing.T, serializer SessionSerializer, values map[interface{}]interface{}) map[interface{}]interface{} {
+	sess := NewSession("id", "", time.Now())
+	sess.Values = values
+	b, err := serializer.Serialize(sess)
+	if err != nil {
+		t.Fatalf("Serialize returned error: %v", err)
+	}
+
+	nsess := NewSession("id", "", time.Now())
+	if err = serializer.Deserialize(b, nsess); err != nil {
+		t.Fatalf("Deserialize returned error: %v", err)
+	}
+	return nsess.Values
+}
+
+func assertKeyValue[T any](t *testing.T, r *http.Request, k Key[T], expected T) {
+	t.Helper()
+	v, ok := k.Get(r)
+	if !ok {
+		t.Fatalf("expected key %s to be found", k.Name())
+	}
+	if !reflect.DeepEqual(v, expected) {
+		t.Fatalf("expected key %s to be %#v, got %#v", k.Name(), expected, v)
+	}
+}
+
+func TestKeySerializers(t *testing.T) {
+	var (
+		intKey    = NewKey[int]("int")
+		int64Key  = NewKey[int64]("int64")
+		floatKey  = NewKey[float64]("float")
+		boolKey   = NewKey[bool]("bool")
+		stringKey = NewKey[string]("string")
+		sliceKey  = NewKey[[]string]("slice")
+		mapKey    = NewKey[map[string]int]("map")
+		userKey   = NewKey[keyTestUser]("user")
+		user      = keyTestUser{Name: "john", Roles: []string{"admin"}}
+	)
+
+	for _, serializer := range []SessionSerializer{GobSerializer{}, JSONSerializer{}} {
+		r := requestWithSession(make(map[interface{}]interface{}))
+		intKey.Set(r, 42)
+		int64Key.Set(r, 1<<40)
+		floatKey.Set(r, 1.5)
+		boolKey.Set(r, true)
+		stringKey.Set(r, "foo")
+		sliceKey.Set(r, []string{"a", "b"})
+		mapKey.Set(r, map[string]int{"a": 1})
+		userKey.Set(r, user)
+
+		data, _ := GetSession(r)
+		r = requestWithSession(roundTrip(t, serializer, data))
+
+		assertKeyValue(t, r, intKey, 42)
+		assertKeyValue(t, r, int64Key, int64(1<<40))
+		assertKeyValue(t, r, floatKey, 1.5)
+		assertKeyValue(t, r, boolKey, true)
+		assertKeyValue(t, r, stringKey, "foo")
+		assertKeyValue(t, r, sliceKey, []string{"a", "b"})
+		assertKeyValue(t, r, mapKey, map[string]int{"a": 1})
+		assertKeyValue(t, r, userKey, user)
+	}
+}
+
+func TestKeyMismatchedType(t *testing.T) {
+	r := requestWithSession(map[interface{}]interface{}{
+		"count": "not a number",
+		"float": 1.5,
+	})
+
+	if v, ok := NewKey[int]("count").Get(r); ok || v != 0 {
+		t.Fatalf("expected Get to fail for mismatched type, returned %v, %v", v, ok)
+	}
+	if v, ok := NewKey[int]("float").Get(r); ok || v != 0 {
+		t.Fatalf("expected Get to fail for non integral number, returned %v, %v", v, ok)
+	}
+	// only the types produced by JSONSerializer are converted
+	r = requestWithSession(map[interface{}]interface{}{
+		"bytes": []byte("hi"),
+		"time":  time.Now(),
+		"map":   map[string]int{"a": 1},
+	})
+	if v, ok := NewKey[string]("bytes").Get(r); ok || v != "" {
+		t.Fatalf("expected Get to fail for []byte value, returned %v, %v", v, ok)
+	}
+	if v, ok := NewKey[string]("time").Get(r); ok || v != "" {
+		t.Fatalf("expected Get to fail for time.Time value, returned %v, %v", v, ok)
+	}
+	if v, ok := NewKey[map[string]float64]("map").Get(r); ok || v != nil {
+		t.Fatalf("expected Get to fail for map of another type, returned %v, %v", v, ok)
+	}
+	if _, ok := NewKey[int]("missing").Get(r); ok {
+		t.Fatal("expected Get to fail for missing key")
+	}
+}
+
+func TestKeyPopDelete(t *testing.T) {
+	k := NewKey[string]("foo")
+	r := requestWithSession(make(map[interface{}]interface{}))
+
+	if err := k.Set(r, "bar"); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if v, ok := k.Pop(r); !ok || v != "bar" {
+		t.Fatalf("expected Pop to return bar, returned %v, %v", v, ok)
+	}
+	if _, ok := k.Pop(r); ok {
+		t.Fatal("expected Pop to remove the key")
+	}
+
+	k.Set(r, "bar")
+	if err := k.Delete(r); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+	if _, ok := k.Get(r); ok {
+		t.Fatal("expected Delete to remove the key")
+	}
+}
+
+func TestKeyWithoutSession(t *testing.T) {
+	k := NewKey[string]("foo")
+	r := httptest.NewRequest("GET", "http://localhost:8080/", nil)
+
+	if err := k.Set(r, "bar"); err == nil {
+		t.Fatal("expected Set to fail without session middleware")
+	}
+	if err := k.Delete(r); err == nil {
+		t.Fatal("expected Delete to fail without session middleware")
+	}
+	if _, ok := k.Get(r); ok {
+		t.Fatal("expected Get to fail without session middleware")
+	}
+}
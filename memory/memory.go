@@ -0,0 +1,267 @@
+package memory
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/syaiful6/sersan"
+)
+
+const shardCount = 32
+
+// MemoryStore implements sersan.Storage keeping the sessions in memory. It's safe
+// for concurrent use by multiple goroutines. Sessions are spread across a number
+// of mutex-protected shards to reduce lock contention, and a secondary index of
+// auth ID is maintained so DestroyAllOfAuthId doesn't need to scan every session.
+//
+// Sessions that are expired according to IdleTimeout and AbsoluteTimeout are
+// treated as non existent, and removed from memory by a janitor goroutine started
+// with StartJanitor.
+type MemoryStore struct {
+	IdleTimeout, AbsoluteTimeout int
+
+	shards [shardCount]*shard
+
+	authMu sync.Mutex
+	auth   map[string]map[string]struct{}
+
+	janitorMu sync.Mutex
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+type shard struct {
+	mu       sync.RWMutex
+	sessions map[string]*sersan.Session
+}
+
+// NewMemoryStore returns an empty MemoryStore. The janitor is not started, call
+// StartJanitor after configuring the timeouts.
+func NewMemoryStore() *MemoryStore {
+	ms := &MemoryStore{
+		IdleTimeout:     604800,  // 7 days
+		AbsoluteTimeout: 5184000, // 60 days
+		auth:            make(map[string]map[string]struct{}),
+	}
+	for i := range ms.shards {
+		ms.shards[i] = &shard{sessions: make(map[string]*sersan.Session)}
+	}
+	return ms
+}
+
+func (ms *MemoryStore) Get(id string) (*sersan.Session, error) {
+	sh := ms.shardFor(id)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	sess, ok := sh.sessions[id]
+	if !ok || ms.isExpired(sess, time.Now().UTC()) {
+		return nil, nil
+	}
+
+	return copySession(sess), nil
+}
+
+func (ms *MemoryStore) Destroy(id string) error {
+	sh := ms.shardFor(id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if sess, ok := sh.sessions[id]; ok {
+		delete(sh.sessions, id)
+		ms.unindex(sess.AuthID, id)
+	}
+
+	return nil
+}
+
+func (ms *MemoryStore) DestroyAllOfAuthId(authId string) error {
+	if authId == "" {
+		return nil
+	}
+
+	ms.authMu.Lock()
+	ids := ms.auth[authId]
+	delete(ms.auth, authId)
+	ms.authMu.Unlock()
+
+	for id := range ids {
+		sh := ms.shardFor(id)
+		sh.mu.Lock()
+		// the session may have been moved to another auth ID since we read the index
+		if sess, ok := sh.sessions[id]; ok && sess.AuthID == authId {
+			delete(sh.sessions, id)
+		}
+		sh.mu.Unlock()
+	}
+
+	return nil
+}
+
+func (ms *MemoryStore) Insert(sess *sersan.Session) error {
+	sh := ms.shardFor(sess.ID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if old, ok := sh.sessions[sess.ID]; ok {
+		if !ms.isExpired(old, time.Now().UTC()) {
+			return sersan.SessionAlreadyExists{ID: sess.ID}
+		}
+		ms.unindex(old.AuthID, old.ID)
+	}
+
+	sh.sessions[sess.ID] = copySession(sess)
+	ms.index(sess.AuthID, sess.ID)
+
+	return nil
+}
+
+func (ms *MemoryStore) Replace(sess *sersan.Session) error {
+	sh := ms.shardFor(sess.ID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	old, ok := sh.sessions[sess.ID]
+	if !ok || ms.isExpired(old, time.Now().UTC()) {
+		return sersan.SessionDoesNotExist{ID: sess.ID}
+	}
+
+	sh.sessions[sess.ID] = copySession(sess)
+	if old.AuthID != sess.AuthID {
+		ms.unindex(old.AuthID, sess.ID)
+		ms.index(sess.AuthID, sess.ID)
+	}
+
+	return nil
+}
+
+// DeleteExpired removes all expired sessions from memory, returns the number of
+// sessions removed.
+func (ms *MemoryStore) DeleteExpired() int {
+	var (
+		n   int
+		now = time.Now().UTC()
+	)
+
+	for _, sh := range ms.shards {
+		sh.mu.Lock()
+		for id, sess := range sh.sessions {
+			if ms.isExpired(sess, now) {
+				delete(sh.sessions, id)
+				ms.unindex(sess.AuthID, id)
+				n++
+			}
+		}
+		sh.mu.Unlock()
+	}
+
+	return n
+}
+
+// StartJanitor starts a goroutine that calls DeleteExpired every interval. It does
+// nothing if the janitor is already running.
+func (ms *MemoryStore) StartJanitor(interval time.Duration) {
+	ms.janitorMu.Lock()
+	defer ms.janitorMu.Unlock()
+
+	if ms.stop != nil {
+		return
+	}
+
+	ms.stop = make(chan struct{})
+	ms.done = make(chan struct{})
+	go ms.janitor(interval, ms.stop, ms.done)
+}
+
+// Close stops the janitor goroutine and waits for it to exit. The sessions are
+// kept, so the store can still be used after Close.
+func (ms *MemoryStore) Close() error {
+	ms.janitorMu.Lock()
+	defer ms.janitorMu.Unlock()
+
+	if ms.stop == nil {
+		return nil
+	}
+
+	close(ms.stop)
+	<-ms.done
+	ms.stop, ms.done = nil, nil
+
+	return nil
+}
+
+func (ms *MemoryStore) janitor(interval time.Duration, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ms.DeleteExpired()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Session never expires if both IdleTimeout and AbsoluteTimeout are disabled.
+func (ms *MemoryStore) isExpired(sess *sersan.Session, now time.Time) bool {
+	if ms.IdleTimeout == 0 && ms.AbsoluteTimeout == 0 {
+		return false
+	}
+	return sess.IsSessionExpired(ms.IdleTimeout, ms.AbsoluteTimeout, now)
+}
+
+func (ms *MemoryStore) shardFor(id string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return ms.shards[h.Sum32()%shardCount]
+}
+
+// index and unindex must be called with the session's shard lock held.
+func (ms *MemoryStore) index(authId, id string) {
+	if authId == "" {
+		return
+	}
+
+	ms.authMu.Lock()
+	defer ms.authMu.Unlock()
+
+	ids, ok := ms.auth[authId]
+	if !ok {
+		ids = make(map[string]struct{})
+		ms.auth[authId] = ids
+	}
+	ids[id] = struct{}{}
+}
+
+func (ms *MemoryStore) unindex(authId, id string) {
+	if authId == "" {
+		return
+	}
+
+	ms.authMu.Lock()
+	defer ms.authMu.Unlock()
+
+	if ids, ok := ms.auth[authId]; ok {
+		delete(ids, id)
+		if len(ids) == 0 {
+			delete(ms.auth, authId)
+		}
+	}
+}
+
+// The session map is handed to request handlers which mutate it, so we never share
+// it with the callers.
+func copySession(sess *sersan.Session) *sersan.Session {
+	nsess := new(sersan.Session)
+	*nsess = *sess
+	nsess.Values = make(map[interface{}]interface{}, len(sess.Values))
+	for k, v := range sess.Values {
+		nsess.Values[k] = v
+	}
+	return nsess
+}
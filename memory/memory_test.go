@@ -0,0 +1,143 @@
+package memory
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/syaiful6/sersan"
+	"github.com/syaiful6/sersan/storagetest"
+)
+
+func TestValuesIsolation(t *testing.T) {
+	ms := NewMemoryStore()
+	sess := storagetest.GenerateSession(false)
+	if err := ms.Insert(sess); err != nil {
+		t.Fatalf("Failed inserting session. return %v", err)
+	}
+
+	gsess, err := ms.Get(sess.ID)
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	if !reflect.DeepEqual(sess, gsess) {
+		t.Fatal("inserted session != get session")
+	}
+
+	// the returned session must not share the values with the stored one.
+	gsess.Values["foo"] = "bar"
+	if gsess, _ = ms.Get(sess.ID); !reflect.DeepEqual(sess, gsess) {
+		t.Fatal("mutating returned session must not change the stored session")
+	}
+}
+
+func TestExpiredSessions(t *testing.T) {
+	ms := NewMemoryStore()
+	ms.IdleTimeout = 60
+
+	expired := storagetest.GenerateSession(true)
+	expired.AccessedAt = expired.AccessedAt.Add(-2 * time.Minute)
+	fresh := storagetest.GenerateSession(true)
+
+	for _, sess := range []*sersan.Session{expired, fresh} {
+		if err := ms.Insert(sess); err != nil {
+			t.Fatalf("Insert returned error: %v", err)
+		}
+	}
+
+	if gsess, _ := ms.Get(expired.ID); gsess != nil {
+		t.Fatal("expired session must not be returned by Get")
+	}
+	if err := ms.Replace(expired); err != (sersan.SessionDoesNotExist{ID: expired.ID}) {
+		t.Fatalf("Replacing expired session must return SessionDoesNotExist. it return %v", err)
+	}
+
+	if n := ms.DeleteExpired(); n != 1 {
+		t.Fatalf("expected DeleteExpired to remove 1 session, removed %d", n)
+	}
+	if _, ok := ms.auth[expired.AuthID]; ok {
+		t.Fatal("expired session must be removed from auth index")
+	}
+	if gsess, _ := ms.Get(fresh.ID); gsess == nil {
+		t.Fatal("fresh session must not be removed by DeleteExpired")
+	}
+}
+
+func TestJanitor(t *testing.T) {
+	ms := NewMemoryStore()
+	ms.AbsoluteTimeout = 60
+
+	sess := storagetest.GenerateSession(false)
+	sess.CreatedAt = sess.CreatedAt.Add(-2 * time.Minute)
+	if err := ms.Insert(sess); err != nil {
+		t.Fatalf("Insert returned error: %v", err)
+	}
+
+	ms.StartJanitor(time.Millisecond)
+	deadline := time.Now().Add(time.Second)
+	for {
+		sh := ms.shardFor(sess.ID)
+		sh.mu.RLock()
+		_, ok := sh.sessions[sess.ID]
+		sh.mu.RUnlock()
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("janitor didn't remove expired session")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := ms.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	if err := ms.Close(); err != nil {
+		t.Fatalf("Close must be idempotent, returned error: %v", err)
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	ms := NewMemoryStore()
+	ms.StartJanitor(time.Millisecond)
+	defer ms.Close()
+
+	authID := storagetest.GenerateSessionId()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				sess := storagetest.GenerateSession(false)
+				sess.AuthID = authID
+				if err := ms.Insert(sess); err != nil {
+					t.Errorf("Insert returned error: %v", err)
+					return
+				}
+				sess.Values["foo"] = "bar"
+				// the session may have been destroyed by another goroutine
+				err := ms.Replace(sess)
+				if _, ok := err.(sersan.SessionDoesNotExist); err != nil && !ok {
+					t.Errorf("Replace returned error: %v", err)
+					return
+				}
+				if _, err := ms.Get(sess.ID); err != nil {
+					t.Errorf("Get returned error: %v", err)
+					return
+				}
+				if j%10 == 0 {
+					ms.DestroyAllOfAuthId(authID)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestStorageSuite(t *testing.T) {
+	storagetest.RunStorageSuite(t, func(t *testing.T) sersan.Storage {
+		return NewMemoryStore()
+	})
+}
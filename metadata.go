@@ -0,0 +1,118 @@
+package sersan
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	// Longer user agents are truncated.
+	maxUserAgentLength = 512
+	maxLabelLength     = 255
+)
+
+// SetLabel sets the label of the request's session, e.g. a device name chosen by
+// the user. It's saved in the session's Metadata.
+func SetLabel(r *http.Request, label string) error {
+	if len(label) > maxLabelLength {
+		return errors.New("sersan: session label is too long")
+	}
+
+	sc, err := getSessionContext(r)
+	if err != nil {
+		return err
+	}
+
+	sc.token.metadata.Label = label
+	return nil
+}
+
+// IPExtractor returns the IP address of the client which sent the request.
+type IPExtractor func(r *http.Request) string
+
+// RemoteAddrIP returns the IP address of the request's peer, ignoring any header.
+// Use it when the application is directly exposed to the clients. It returns an
+// empty string if RemoteAddr isn't an IP address, with or without a port.
+func RemoteAddrIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if net.ParseIP(host) == nil {
+		return ""
+	}
+	return host
+}
+
+// ForwardedForIP returns an IPExtractor reading the X-Forwarded-For header set by
+// the trusted proxies, given as IP addresses or CIDR ranges. The header is only
+// used if the request's peer is trusted, and its addresses are read from right to
+// left, returning the first one which isn't trusted. Addresses before it may be
+// forged by the client and are ignored.
+func ForwardedForIP(trustedProxies ...string) (IPExtractor, error) {
+	var nets []*net.IPNet
+	for _, proxy := range trustedProxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("sersan: invalid trusted proxy address: %s", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("sersan: invalid trusted proxy range: %s", proxy)
+		}
+		nets = append(nets, ipnet)
+	}
+
+	trusted := func(addr string) bool {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return false
+		}
+		for _, n := range nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(r *http.Request) string {
+		ip := RemoteAddrIP(r)
+		if !trusted(ip) {
+			return ip
+		}
+
+		var forwarded []string
+		for _, h := range r.Header.Values("X-Forwarded-For") {
+			forwarded = append(forwarded, strings.Split(h, ",")...)
+		}
+		for i := len(forwarded) - 1; i >= 0; i-- {
+			addr := strings.TrimSpace(forwarded[i])
+			if addr == "" {
+				continue
+			}
+			if net.ParseIP(addr) == nil {
+				// garbage, we can't go further
+				return ip
+			}
+			ip = addr
+			if !trusted(addr) {
+				break
+			}
+		}
+
+		return ip
+	}, nil
+}
@@ -0,0 +1,161 @@
+package sersan
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRemoteAddrIP(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		expected   string
+	}{
+		{"192.0.2.1:1234", "192.0.2.1"},
+		{"[2001:db8::1]:1234", "2001:db8::1"},
+		{"192.0.2.1", "192.0.2.1"},
+		{"", ""},
+		{"example.com:1234", ""},
+		{strings.Repeat("a", 100), ""},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "http://localhost:8080/", nil)
+		r.RemoteAddr = test.remoteAddr
+		if ip := RemoteAddrIP(r); ip != test.expected {
+			t.Errorf("expected IP %q for %q, got %q", test.expected, test.remoteAddr, ip)
+		}
+	}
+}
+
+func TestForwardedForIP(t *testing.T) {
+	extractor, err := ForwardedForIP("10.0.0.0/8", "192.0.2.1")
+	if err != nil {
+		t.Fatalf("ForwardedForIP returned error: %v", err)
+	}
+
+	tests := []struct {
+		remoteAddr string
+		forwarded  []string
+		expected   string
+	}{
+		// untrusted peer, the header is ignored
+		{"203.0.113.5:1234", []string{"198.51.100.1"}, "203.0.113.5"},
+		{"10.0.0.1:1234", nil, "10.0.0.1"},
+		{"10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		// forged addresses before the first untrusted one are ignored
+		{"10.0.0.1:1234", []string{"1.2.3.4, 198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"192.0.2.1:1234", []string{"1.2.3.4", "198.51.100.1, 192.0.2.1"}, "198.51.100.1"},
+		// only trusted proxies
+		{"10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"10.0.0.1:1234", []string{"garbage, 10.0.0.2"}, "10.0.0.2"},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "http://localhost:8080/", nil)
+		r.RemoteAddr = test.remoteAddr
+		for _, h := range test.forwarded {
+			r.Header.Add("X-Forwarded-For", h)
+		}
+		if ip := extractor(r); ip != test.expected {
+			t.Errorf("expected IP %s for %s, forwarded for %v, got %s", test.expected, test.remoteAddr, test.forwarded, ip)
+		}
+	}
+
+	if _, err = ForwardedForIP("not an ip"); err == nil {
+		t.Fatal("expected ForwardedForIP to reject invalid address")
+	}
+	if _, err = ForwardedForIP("10.0.0.0/33"); err == nil {
+		t.Fatal("expected ForwardedForIP to reject invalid range")
+	}
+}
+
+func TestCaptureMetadata(t *testing.T) {
+	storage := NewStorageRecorder()
+	ss := NewServerSessionState(storage, []byte("secret-key"))
+	ss.SetCookieName("session-name")
+	ss.CaptureMetadata = true
+
+	handler := SessionMiddleware(ss)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess, _ := GetSession(r)
+		sess["foo"] = "bar"
+		if label := r.URL.Query().Get("label"); label != "" {
+			if err := SetLabel(r, label); err != nil {
+				t.Errorf("SetLabel returned error: %v", err)
+			}
+		}
+	}))
+
+	r := httptest.NewRequest("GET", "http://localhost:8080/", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("User-Agent", "test-agent")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	op := storage.GetOperations()
+	if len(op) != 1 || op[0].Tag != "Insert" {
+		t.Fatal("expected session to be inserted")
+	}
+	sess := op[0].Session
+	if sess.Metadata != (Metadata{IP: "192.0.2.1", LastSeenIP: "192.0.2.1", UserAgent: "test-agent"}) {
+		t.Fatalf("unexpected metadata for new session: %+v", sess.Metadata)
+	}
+
+	// same client, nothing to update
+	cookie := w.Result().Cookies()[0]
+	r = httptest.NewRequest("GET", "http://localhost:8080/", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.AddCookie(cookie)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if op = storage.GetOperations(); len(op) != 1 || op[0].Tag != "Get" {
+		t.Fatal("expected unmodified session not to be saved")
+	}
+
+	// another IP address and a label
+	r = httptest.NewRequest("GET", "http://localhost:8080/?label=laptop", nil)
+	r.RemoteAddr = "198.51.100.1:1234"
+	r.Header.Set("User-Agent", "other-agent")
+	r.AddCookie(cookie)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	op = storage.GetOperations()
+	if len(op) != 2 || op[1].Tag != "Replace" {
+		t.Fatal("expected session to be replaced when the client changed")
+	}
+	expected := Metadata{IP: "192.0.2.1", LastSeenIP: "198.51.100.1", UserAgent: "test-agent", Label: "laptop"}
+	if op[1].Session.Metadata != expected {
+		t.Fatalf("unexpected metadata %+v, expected %+v", op[1].Session.Metadata, expected)
+	}
+}
+
+func TestMetadataSurviveRotation(t *testing.T) {
+	storage := NewStorageRecorder()
+	ss := NewServerSessionState(storage)
+
+	data, token, _ := ss.Load("")
+	token.setClient("192.0.2.1", strings.Repeat("a", 1000))
+	data["foo"] = "bar"
+	sess, err := ss.Save(token, data)
+	if err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	if len(sess.Metadata.UserAgent) != maxUserAgentLength {
+		t.Fatalf("expected user agent to be truncated to %d bytes, got %d", maxUserAgentLength, len(sess.Metadata.UserAgent))
+	}
+
+	data, token, _ = ss.Load(sess.ID)
+	token.setClient("198.51.100.1", "other-agent")
+	data[ss.AuthKey] = "john"
+	nsess, err := ss.Save(token, data)
+	if err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	if nsess.ID == sess.ID || nsess.Metadata.IP != "192.0.2.1" || nsess.Metadata.LastSeenIP != "198.51.100.1" {
+		t.Fatalf("expected metadata to be kept when the session ID is rotated, got %+v", nsess.Metadata)
+	}
+
+	if err = SetLabel(requestWithSession(data), strings.Repeat("a", 256)); err == nil {
+		t.Fatal("expected SetLabel to reject long labels")
+	}
+}
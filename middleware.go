@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/securecookie"
 )
@@ -12,7 +13,12 @@ type sessionResponseWriter struct {
 	http.ResponseWriter
 
 	hasWritten bool
+	// the session couldn't be loaded, it must not be saved
+	degraded bool
+	// error saving the session, the handler's response is discarded
+	err error
 
+	r     *http.Request
 	data  map[interface{}]interface{}
 	token *SaveSessionToken
 	ss    *ServerSessionState
@@ -27,8 +33,30 @@ func newSessionResponseWriter(w http.ResponseWriter, token *SaveSessionToken) *s
 
 type sessionContextKey struct{}
 
+// Value saved in the request's context by SessionMiddleware.
+type sessionContext struct {
+	data  map[interface{}]interface{}
+	token *SaveSessionToken
+	ss    *ServerSessionState
+}
+
 // SessionMiddleware for loading and saving session data. Make sure to use this
-// middleware.
+// middleware. The storage backend is called with the request's context, so
+// storage operations are aborted when the client goes away or the request's
+// deadline is exceeded.
+//
+// The session is saved, and its cookie set, right before the response's header
+// is written, so the handler must be done with the session by the time it calls
+// WriteHeader or Write. If the handler writes nothing, the session is saved after
+// it returns.
+//
+// The ResponseWriter passed to the handler implements http.Flusher, http.Hijacker
+// and http.Pusher when the original one does. Flushing or hijacking the connection
+// saves the session too.
+//
+// Errors loading or saving the session are reported with ss.ErrorHandler, in that
+// case the response written by the handler is discarded. Set ss.DegradeOnError to
+// serve the request anyway.
 func SessionMiddleware(ss *ServerSessionState) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -39,19 +67,35 @@ func SessionMiddleware(ss *ServerSessionState) func(http.Handler) http.Handler {
 					sessId = ""
 				}
 			}
-			data, token, err := ss.Load(sessId)
+			data, token, err := ss.LoadRequest(r, sessId)
+			degraded := false
 			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
+				if !ss.DegradeOnError {
+					ss.handleError(w, r, err)
+					return
+				}
+				ss.logf("sersan: serving request with empty session, load failed: %v", err)
+				data = make(map[interface{}]interface{})
+				token = &SaveSessionToken{now: time.Now().UTC()}
+				degraded = true
 			}
 
+			nr := r.WithContext(context.WithValue(r.Context(), sessionContextKey{},
+				&sessionContext{data: data, token: token, ss: ss}))
+
 			nw := newSessionResponseWriter(w, token)
+			nw.r = nr
 			nw.data = data
 			nw.ss = ss
+			nw.degraded = degraded
 
-			nr := r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, data))
+			next.ServeHTTP(wrapResponseWriter(nw), nr)
 
-			next.ServeHTTP(nw, nr)
+			// the handler didn't write anything, the session must be saved now
+			// before net/http sends the implicit 200 response.
+			if !nw.hasWritten {
+				nw.saveSession()
+			}
 		})
 	}
 }
@@ -59,10 +103,17 @@ func SessionMiddleware(ss *ServerSessionState) func(http.Handler) http.Handler {
 // Get session data associated for this request. Make sure call this function after
 // `SessionMiddleare` run.
 func GetSession(r *http.Request) (map[interface{}]interface{}, error) {
-	var ctx = r.Context()
-	data := ctx.Value(sessionContextKey{})
-	if data != nil {
-		return data.(map[interface{}]interface{}), nil
+	sc, err := getSessionContext(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return sc.data, nil
+}
+
+func getSessionContext(r *http.Request) (*sessionContext, error) {
+	if sc, ok := r.Context().Value(sessionContextKey{}).(*sessionContext); ok {
+		return sc, nil
 	}
 
 	return nil, errors.New("sersan: no session data found in request, perhaps you didn't use Sersan's middleware?")
@@ -70,35 +121,53 @@ func GetSession(r *http.Request) (map[interface{}]interface{}, error) {
 
 func (w *sessionResponseWriter) WriteHeader(code int) {
 	if !w.hasWritten {
-		if err := w.saveSession(); err != nil {
-			panic(err)
-		}
+		w.saveSession()
+	}
+	if w.err != nil {
+		return
 	}
 	w.ResponseWriter.WriteHeader(code)
 }
 
 func (w *sessionResponseWriter) Write(b []byte) (int, error) {
 	if !w.hasWritten {
-		if err := w.saveSession(); err != nil {
-			return 0, err
-		}
+		w.saveSession()
+	}
+	if w.err != nil {
+		return 0, w.err
 	}
 	return w.ResponseWriter.Write(b)
 }
 
-func (w *sessionResponseWriter) saveSession() error {
+// Save the session and set its cookie. If it fails, the error is reported with
+// ServerSessionState.ErrorHandler, unless DegradeOnError is set.
+func (w *sessionResponseWriter) saveSession() {
 	if w.hasWritten {
 		panic("should not call saveSession twice")
 	}
 
 	w.hasWritten = true
+	if w.degraded {
+		return
+	}
+
+	if err := w.doSaveSession(); err != nil {
+		if w.ss.DegradeOnError {
+			w.ss.logf("sersan: session not saved: %v", err)
+			return
+		}
+		w.err = err
+		w.ss.handleError(w.ResponseWriter, w.r, err)
+	}
+}
 
+func (w *sessionResponseWriter) doSaveSession() error {
 	var (
 		err  error
 		sess *Session
 	)
 
-	if sess, err = w.ss.Save(w.token, w.data); err != nil {
+	if sess, err = w.ss.SaveContext(w.r.Context(), w.token, w.data); err != nil {
 		return err
 	}
 
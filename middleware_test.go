@@ -1,9 +1,14 @@
 package sersan
 
 import (
+	"errors"
+	"io/ioutil"
+	"log"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	"github.com/gorilla/securecookie"
 )
 
 func newAppSetSession(key, value string, ss *ServerSessionState) http.Handler {
@@ -71,3 +76,169 @@ func TestBasicSession(t *testing.T) {
 		t.Fatalf("session values not persisted correctly, want 'bar', actual '%s'", body)
 	}
 }
+
+type failingStorage struct {
+	*StorageRecorder
+}
+
+var errStorageDown = errors.New("storage is down")
+
+func (s failingStorage) Get(id string) (*Session, error) {
+	return nil, errStorageDown
+}
+
+func (s failingStorage) Insert(sess *Session) error {
+	return errStorageDown
+}
+
+func TestSaveSessionWithoutWrite(t *testing.T) {
+	storage := NewStorageRecorder()
+	ss := NewServerSessionState(storage, []byte("secret-key"))
+	ss.SetCookieName("session-name")
+	handler := SessionMiddleware(ss)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess, err := GetSession(r)
+		if err != nil {
+			panic(err)
+		}
+		sess["foo"] = "bar"
+	}))
+
+	r := httptest.NewRequest("GET", "http://localhost:8080/", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status code 200, got %d", w.Code)
+	}
+	if cookies := w.Result().Cookies(); len(cookies) != 1 || cookies[0].Name != ss.cookieName || cookies[0].MaxAge <= 0 {
+		t.Fatalf("expected session cookie to be set, got %v", cookies)
+	}
+	op := storage.GetOperations()
+	if len(op) != 1 || op[0].Tag != "Insert" || op[0].Session.Values["foo"] != "bar" {
+		t.Fatal("expected session to be inserted after handler returned")
+	}
+
+	// the handler wrote the response, the session isn't saved again
+	handler = newAppSetSession("foo", "bar", ss)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if op = storage.GetOperations(); len(op) != 1 {
+		t.Fatalf("expected session to be saved once, got %d operations", len(op))
+	}
+	if cookies := w.Result().Cookies(); len(cookies) != 1 {
+		t.Fatalf("expected a single session cookie, got %v", cookies)
+	}
+}
+
+func TestSaveSessionWithoutWriteFailed(t *testing.T) {
+	ss := NewServerSessionState(failingStorage{NewStorageRecorder()}, []byte("secret-key"))
+	ss.SetCookieName("session-name")
+	handler := SessionMiddleware(ss)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess, _ := GetSession(r)
+		sess["foo"] = "bar"
+	}))
+
+	r := httptest.NewRequest("GET", "http://localhost:8080/", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status code 500, got %d", w.Code)
+	}
+	if cookies := w.Result().Cookies(); len(cookies) != 0 {
+		t.Fatalf("expected no cookie when the session failed to save, got %v", cookies)
+	}
+}
+
+func newFailingSessionState() *ServerSessionState {
+	ss := NewServerSessionState(failingStorage{NewStorageRecorder()}, []byte("secret-key"))
+	ss.SetCookieName("session-name")
+	ss.ErrorLog = log.New(ioutil.Discard, "", 0)
+	ss.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(err.Error()))
+	}
+	return ss
+}
+
+func newRequestWithSession(ss *ServerSessionState, id string) *http.Request {
+	encoded, err := securecookie.EncodeMulti(ss.cookieName, id, ss.Codecs...)
+	if err != nil {
+		panic(err)
+	}
+	r := httptest.NewRequest("GET", "http://localhost:8080/", nil)
+	r.AddCookie(&http.Cookie{Name: ss.cookieName, Value: encoded})
+	return r
+}
+
+func TestLoadSessionFailed(t *testing.T) {
+	ss := newFailingSessionState()
+	handler := newAppSetSession("foo", "bar", ss)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newRequestWithSession(ss, "session-id"))
+
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != errStorageDown.Error() {
+		t.Fatalf("expected response from ErrorHandler, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestLoadSessionDegraded(t *testing.T) {
+	ss := newFailingSessionState()
+	ss.DegradeOnError = true
+	handler := SessionMiddleware(ss)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess, err := GetSession(r)
+		if err != nil {
+			panic(err)
+		}
+		if len(sess) != 0 {
+			t.Error("expected empty session when storage is down")
+		}
+		sess["foo"] = "bar"
+		w.Write([]byte("ok"))
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newRequestWithSession(ss, "session-id"))
+
+	if w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Fatalf("expected request to be served, got %d %q", w.Code, w.Body.String())
+	}
+	if cookies := w.Result().Cookies(); len(cookies) != 0 {
+		t.Fatalf("expected no cookie for degraded session, got %v", cookies)
+	}
+}
+
+func TestSaveSessionFailed(t *testing.T) {
+	ss := newFailingSessionState()
+	handler := SessionMiddleware(ss)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess, _ := GetSession(r)
+		sess["foo"] = "bar"
+
+		w.WriteHeader(http.StatusCreated)
+		if _, err := w.Write([]byte("created")); err != errStorageDown {
+			t.Errorf("expected Write to return the save error, got %v", err)
+		}
+	}))
+
+	r := httptest.NewRequest("GET", "http://localhost:8080/", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != errStorageDown.Error() {
+		t.Fatalf("expected response from ErrorHandler, got %d %q", w.Code, w.Body.String())
+	}
+
+	// degraded, the response is sent without the cookie
+	ss.DegradeOnError = true
+	w = httptest.NewRecorder()
+	handler = newAppSetSession("foo", "bar", ss)
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK || w.Body.String() != "foo:bar" {
+		t.Fatalf("expected request to be served, got %d %q", w.Code, w.Body.String())
+	}
+	if cookies := w.Result().Cookies(); len(cookies) != 0 {
+		t.Fatalf("expected no cookie when the session failed to save, got %v", cookies)
+	}
+}
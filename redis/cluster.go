@@ -0,0 +1,144 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Number of hash slots of a Redis Cluster
+const numSlots = 16384
+
+// ClusterNode is a master of a Redis Cluster, with the hash slots it serves.
+type ClusterNode struct {
+	Pool *redis.Pool
+	// Hash slots served by the node, as inclusive ranges
+	Slots [][2]int
+}
+
+// ClusterPool routes the connections of a RediStore to the nodes of a Redis Cluster,
+// by the hash slot of the key the commands are sent for. The slots are not updated
+// when the cluster is resharded: commands failing with MOVED errors are returned
+// as is, create a new ClusterPool when the slots move.
+type ClusterPool struct {
+	nodes []*redis.Pool
+	slots [numSlots]*redis.Pool
+}
+
+// NewClusterPool creates a ClusterPool for the given nodes, which must serve all
+// the hash slots.
+func NewClusterPool(nodes ...ClusterNode) (*ClusterPool, error) {
+	cp := &ClusterPool{}
+	for _, node := range nodes {
+		for _, r := range node.Slots {
+			if r[0] < 0 || r[1] >= numSlots || r[0] > r[1] {
+				return nil, fmt.Errorf("sersan/redis: invalid hash slot range %d-%d", r[0], r[1])
+			}
+			for slot := r[0]; slot <= r[1]; slot++ {
+				cp.slots[slot] = node.Pool
+			}
+		}
+		cp.nodes = append(cp.nodes, node.Pool)
+	}
+
+	for slot, pool := range cp.slots {
+		if pool == nil {
+			return nil, fmt.Errorf("sersan/redis: hash slot %d is not served by any node", slot)
+		}
+	}
+
+	return cp, nil
+}
+
+// DiscoverClusterNodes asks the cluster the hash slots of its masters with CLUSTER
+// SLOTS, creating their pools with newPool.
+func DiscoverClusterNodes(conn redis.Conn, newPool func(addr string) *redis.Pool) ([]ClusterNode, error) {
+	ranges, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := []ClusterNode{}
+	byAddr := make(map[string]int)
+	for _, r := range ranges {
+		var (
+			start, end int
+			master     []interface{}
+		)
+		values, err := redis.Values(r, nil)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = redis.Scan(values, &start, &end, &master); err != nil {
+			return nil, err
+		}
+		var (
+			host string
+			port int
+		)
+		if _, err = redis.Scan(master, &host, &port); err != nil {
+			return nil, err
+		}
+
+		addr := fmt.Sprintf("%s:%d", host, port)
+		i, ok := byAddr[addr]
+		if !ok {
+			i = len(nodes)
+			byAddr[addr] = i
+			nodes = append(nodes, ClusterNode{Pool: newPool(addr)})
+		}
+		nodes[i].Slots = append(nodes[i].Slots, [2]int{start, end})
+	}
+
+	return nodes, nil
+}
+
+// GetContext gets a connection to the node serving the hash slot of key.
+func (cp *ClusterPool) GetContext(ctx context.Context, key string) (redis.Conn, error) {
+	return cp.slots[KeySlot(key)].GetContext(ctx)
+}
+
+// Nodes returns the pools of all the nodes.
+func (cp *ClusterPool) Nodes() []*redis.Pool {
+	return cp.nodes
+}
+
+// Close closes the pools of all the nodes.
+func (cp *ClusterPool) Close() error {
+	var err error
+	for _, pool := range cp.nodes {
+		if cerr := pool.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// KeySlot returns the hash slot of the key in a Redis Cluster. Only the part of the
+// key between the first '{' and the following '}' is hashed, if it's not empty.
+func KeySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) % numSlots
+}
+
+// CRC16 (XMODEM) used by Redis Cluster
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
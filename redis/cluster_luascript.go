@@ -0,0 +1,160 @@
+package redis
+
+import (
+	"github.com/gomodule/redigo/redis"
+)
+
+// The scripts below run on Redis Cluster. They only access the keys of a session,
+// tagged with its ID so they're on the same node, and return its auth ID: the auth
+// sets live on other nodes and are updated separately, see NewClusterRediStore.
+
+// Lua script for inserting session, returns 0 if the session already exists
+//
+// KEYS[1] - session's ID
+// ARGV[1] - Expiration in seconds
+// ARGV... - Session Data
+var clusterInsertScript = redis.NewScript(1, `
+	if(redis.call('EXISTS', KEYS[1]) == 1) then
+		return 0
+	end
+
+	local sessions = {}
+	for i = 2, #ARGV, 1 do
+		sessions[#sessions + 1] = ARGV[i]
+	end
+	redis.call('HMSET', KEYS[1], unpack(sessions))
+	if(ARGV[1] ~= '') then
+		redis.call('EXPIRE', KEYS[1], ARGV[1])
+	end
+
+	return 1
+`)
+
+// Lua script for replace/update session, returns the status and the old auth ID of
+// the session. The status is -1 if the session doesn't exist and 0 if its version
+// isn't the expected one
+//
+// KEYS[1] - Session ID
+// ARGV[1] - expiration in second
+// ARGV[2] - expected version of the session, empty to replace it unconditionally
+// ARGV... - session data
+var clusterReplaceScript = redis.NewScript(1, `
+	local oldAuthID = redis.call('HGET', KEYS[1], 'AuthID')
+	if(not oldAuthID) then
+		return {-1, ''}
+	end
+	if(ARGV[2] ~= '') then
+		local version = redis.call('HGET', KEYS[1], 'Version') or '0'
+		if(tonumber(version) ~= tonumber(ARGV[2])) then
+			return {0, oldAuthID}
+		end
+	end
+
+	redis.call('DEL', KEYS[1])
+	local sessions = {}
+	for i = 3, #ARGV, 1 do
+		sessions[#sessions + 1] = ARGV[i]
+	end
+	redis.call('HMSET', KEYS[1], unpack(sessions))
+	if(ARGV[1] ~= '') then
+		redis.call('EXPIRE', KEYS[1], ARGV[1])
+	end
+
+	return {1, oldAuthID}
+`)
+
+// Lua script for destroying a session, returns its auth ID
+//
+// KEYS[1] - Session ID
+var clusterDestroyScript = redis.NewScript(1, `
+	local authID = redis.call('HGET', KEYS[1], 'AuthID')
+	redis.call('DEL', KEYS[1])
+
+	return authID
+`)
+
+// Lua script for destroying a session only if it belongs to the given auth ID
+//
+// KEYS[1] - Session ID
+// ARGV[1] - Auth ID
+var destroyIfAuthScript = redis.NewScript(1, `
+	if(redis.call('HGET', KEYS[1], 'AuthID') == ARGV[1]) then
+		return redis.call('DEL', KEYS[1])
+	end
+
+	return 0
+`)
+
+// Lua script for updating the access time of a session, returns its auth ID
+//
+// KEYS[1] - Session ID
+// ARGV[1] - expiration in second
+// ARGV[2] - access time
+var clusterTouchScript = redis.NewScript(1, `
+	local authID = redis.call('HGET', KEYS[1], 'AuthID')
+	if(not authID) then
+		return false
+	end
+	redis.call('HSET', KEYS[1], 'AccessedAt', ARGV[2])
+	redis.call('EXPIRE', KEYS[1], ARGV[1])
+
+	return authID
+`)
+
+// Lua script for adding a session to an auth set
+//
+// KEYS[1] - Auth key
+// ARGV[1] - Session key
+// ARGV[2] - expiration of the session in second
+var indexAddScript = redis.NewScript(1, extendExpireFunc+`
+	redis.call('SADD', KEYS[1], ARGV[1])
+	extendExpire(KEYS[1], ARGV[2])
+
+	return true
+`)
+
+// Lua script for destroying a session and keeping its ID as an alias of another
+// session, returns the auth ID of the session or false if it doesn't exist
+//
+// KEYS[1] - Session ID
+// KEYS[2] - Alias key
+// ARGV[1] - Target session ID
+// ARGV[2] - expiration of the alias in second
+var clusterAliasScript = redis.NewScript(2, `
+	local authID = redis.call('HGET', KEYS[1], 'AuthID')
+	if(not authID) then
+		return false
+	end
+	redis.call('DEL', KEYS[1])
+	redis.call('SET', KEYS[2], ARGV[1], 'EX', ARGV[2])
+
+	return authID
+`)
+
+// Lua script for applying the changes made to a session, returns its auth ID and
+// its number of value fields
+//
+// KEYS[1] - Session ID
+// ARGV[1] - expiration in second
+// ARGV... - fields to set
+var clusterDeltaScript = redis.NewScript(1, `
+	local authID = redis.call('HGET', KEYS[1], 'AuthID')
+	if(not authID) then
+		return false
+	end
+	local fields = {}
+	for i = 2, #ARGV, 1 do
+		fields[#fields + 1] = ARGV[i]
+	end
+	redis.call('HMSET', KEYS[1], unpack(fields))
+	redis.call('HINCRBY', KEYS[1], 'Version', 1)
+	redis.call('EXPIRE', KEYS[1], ARGV[1])
+	local count = 0
+	for _, field in ipairs(redis.call('HKEYS', KEYS[1])) do
+		if(string.sub(field, 1, 2) == 'v:') then
+			count = count + 1
+		end
+	end
+
+	return {authID, count}
+`)
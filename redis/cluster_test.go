@@ -0,0 +1,269 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+
+	"github.com/syaiful6/sersan"
+	"github.com/syaiful6/sersan/storagetest"
+)
+
+// hash slots of the nodes of the test cluster
+var testClusterSlots = [][2]int{{0, 5460}, {5461, 10922}, {10923, 16383}}
+
+func newPoolFor(addr string) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     10,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr)
+		},
+	}
+}
+
+// Starts a cluster of in-process Redis servers, each serving a third of the
+// hash slots.
+func newTestCluster(t *testing.T) ([]*miniredis.Miniredis, *ClusterPool) {
+	servers := []*miniredis.Miniredis{}
+	nodes := []ClusterNode{}
+	for _, slots := range testClusterSlots {
+		m := miniredis.RunT(t)
+		servers = append(servers, m)
+		nodes = append(nodes, ClusterNode{Pool: newPoolFor(m.Addr()), Slots: [][2]int{slots}})
+	}
+
+	cluster, err := NewClusterPool(nodes...)
+	if err != nil {
+		t.Fatalf("NewClusterPool returned error: %v", err)
+	}
+	t.Cleanup(func() { cluster.Close() })
+
+	return servers, cluster
+}
+
+// Fails if a node holds keys of hash slots it doesn't serve, e.g. keys written
+// by a script on behalf of another node.
+func assertKeysOnTheirNode(t *testing.T, servers []*miniredis.Miniredis) {
+	for i, m := range servers {
+		for _, key := range m.Keys() {
+			slot := KeySlot(key)
+			if slot < testClusterSlots[i][0] || slot > testClusterSlots[i][1] {
+				t.Fatalf("key %q of hash slot %d found on node %d", key, slot, i)
+			}
+		}
+	}
+}
+
+func TestKeySlot(t *testing.T) {
+	tests := []struct {
+		key  string
+		slot int
+	}{
+		{"foo", 12182},
+		{"somekey", 11058},
+		{"foo{hash_tag}", 2515},
+		{"bar{hash_tag}", 2515},
+	}
+	for _, test := range tests {
+		if slot := KeySlot(test.key); slot != test.slot {
+			t.Errorf("expected hash slot of %q to be %d, got %d", test.key, test.slot, slot)
+		}
+	}
+
+	if KeySlot("{user1000}.following") != KeySlot("user1000") {
+		t.Error("expected only the hash tag to be hashed")
+	}
+	if KeySlot("foo{}{bar}") == KeySlot("bar") {
+		t.Error("expected an empty hash tag to be ignored")
+	}
+}
+
+func TestNewClusterPool(t *testing.T) {
+	pool := newPoolFor("127.0.0.1:0")
+	if _, err := NewClusterPool(ClusterNode{Pool: pool, Slots: [][2]int{{0, 100}}}); err == nil {
+		t.Fatal("expected NewClusterPool to fail when hash slots aren't served")
+	}
+	if _, err := NewClusterPool(ClusterNode{Pool: pool, Slots: [][2]int{{0, numSlots}}}); err == nil {
+		t.Fatal("expected NewClusterPool to fail with an invalid hash slot range")
+	}
+}
+
+func TestDiscoverClusterNodes(t *testing.T) {
+	m := miniredis.RunT(t)
+	conn, err := redis.Dial("tcp", m.Addr())
+	if err != nil {
+		t.Fatalf("Dial returned error: %v", err)
+	}
+	defer conn.Close()
+
+	addrs := []string{}
+	nodes, err := DiscoverClusterNodes(conn, func(addr string) *redis.Pool {
+		addrs = append(addrs, addr)
+		return newPoolFor(addr)
+	})
+	if err != nil {
+		t.Fatalf("DiscoverClusterNodes returned error: %v", err)
+	}
+	if len(nodes) != 1 || len(addrs) != 1 || addrs[0] != m.Addr() {
+		t.Fatalf("expected a single node at %s, got %v", m.Addr(), addrs)
+	}
+	if len(nodes[0].Slots) != 1 || nodes[0].Slots[0] != [2]int{0, numSlots - 1} {
+		t.Fatalf("expected the node to serve all the hash slots, got %v", nodes[0].Slots)
+	}
+
+	cluster, err := NewClusterPool(nodes...)
+	if err != nil {
+		t.Fatalf("NewClusterPool returned error: %v", err)
+	}
+	defer cluster.Close()
+	if _, err = NewClusterRediStore(cluster); err != nil {
+		t.Fatalf("NewClusterRediStore returned error: %v", err)
+	}
+}
+
+func TestClusterStorageSuite(t *testing.T) {
+	storagetest.RunStorageSuite(t, func(t *testing.T) sersan.Storage {
+		servers, cluster := newTestCluster(t)
+		t.Cleanup(func() { assertKeysOnTheirNode(t, servers) })
+
+		rs, err := NewClusterRediStore(cluster)
+		if err != nil {
+			t.Fatalf("can't create redistore, returned %v", err)
+		}
+		return rs
+	})
+}
+
+func TestClusterAuthIndex(t *testing.T) {
+	servers, cluster := newTestCluster(t)
+	rs, err := NewClusterRediStore(cluster)
+	if err != nil {
+		t.Fatalf("can't create redistore, returned %v", err)
+	}
+
+	master := storagetest.GenerateSession(true)
+	sessions := []*sersan.Session{master}
+	for i := 0; i < 10; i++ {
+		sessions = append(sessions, storagetest.CloneSession(storagetest.GenerateSession(false), master.AuthID))
+	}
+	for _, sess := range sessions {
+		if err = rs.Insert(sess); err != nil {
+			t.Fatalf("Insert returned error: %v", err)
+		}
+	}
+
+	// moved to another auth ID
+	moved := storagetest.CloneSession(sessions[1], storagetest.GenerateSessionId())
+	if err = rs.Replace(moved); err != nil {
+		t.Fatalf("Replace returned error: %v", err)
+	}
+	if err = rs.Touch(sessions[2].ID, time.Now().UTC(), 60); err != nil {
+		t.Fatalf("Touch returned error: %v", err)
+	}
+	delta := &sersan.SessionDelta{ID: sessions[3].ID, Updated: map[interface{}]interface{}{"foo": "bar"}}
+	if err = rs.ApplyDelta(delta, 60); err != nil {
+		t.Fatalf("ApplyDelta returned error: %v", err)
+	}
+	if err = rs.Alias(sessions[4].ID, master.ID, 60); err != nil {
+		t.Fatalf("Alias returned error: %v", err)
+	}
+	if target, err := rs.ResolveAlias(sessions[4].ID); err != nil || target != master.ID {
+		t.Fatalf("expected alias to resolve to %s, got %q, %v", master.ID, target, err)
+	}
+	if err = rs.Destroy(sessions[5].ID); err != nil {
+		t.Fatalf("Destroy returned error: %v", err)
+	}
+
+	listed, err := rs.ListByAuthId(master.AuthID)
+	if err != nil {
+		t.Fatalf("ListByAuthId returned error: %v", err)
+	}
+	if len(listed) != len(sessions)-3 {
+		t.Fatalf("expected ListByAuthId to return %d sessions, returned %d", len(sessions)-3, len(listed))
+	}
+	if gsess, _ := rs.Get(sessions[3].ID); gsess == nil || gsess.Values["foo"] != "bar" {
+		t.Fatal("expected the delta to be applied")
+	}
+
+	// a member of the set left behind, e.g. by a failed update of the set
+	authKey := rs.authKey(master.AuthID)
+	conn, err := cluster.GetContext(context.Background(), authKey)
+	if err != nil {
+		t.Fatalf("GetContext returned error: %v", err)
+	}
+	defer conn.Close()
+	if _, err = conn.Do("SADD", authKey, rs.sessionKey(moved.ID)); err != nil {
+		t.Fatalf("SADD returned error: %v", err)
+	}
+	if removed, err := rs.PruneAuthIndexes(); err != nil || removed != 1 {
+		t.Fatalf("expected PruneAuthIndexes to remove 1 session, removed %d, %v", removed, err)
+	}
+
+	if err = rs.DestroyByAuthIdExcept(master.AuthID, master.ID); err != nil {
+		t.Fatalf("DestroyByAuthIdExcept returned error: %v", err)
+	}
+	if listed, err = rs.ListByAuthId(master.AuthID); err != nil || len(listed) != 1 || listed[0].ID != master.ID {
+		t.Fatal("expected DestroyByAuthIdExcept to keep only the given session")
+	}
+	if err = rs.DestroyAllOfAuthId(master.AuthID); err != nil {
+		t.Fatalf("DestroyAllOfAuthId returned error: %v", err)
+	}
+	if gsess, _ := rs.Get(master.ID); gsess != nil {
+		t.Fatal("expected DestroyAllOfAuthId to delete the sessions of the auth ID")
+	}
+	if gsess, _ := rs.Get(moved.ID); gsess == nil {
+		t.Fatal("DestroyAllOfAuthId must not delete sessions of other auth ID")
+	}
+
+	assertKeysOnTheirNode(t, servers)
+}
+
+func TestClusterSingleConnectionPools(t *testing.T) {
+	servers, cluster := newTestCluster(t)
+	// a connection held while taking another from the same pool would deadlock
+	for _, pool := range cluster.Nodes() {
+		pool.MaxActive = 1
+		pool.Wait = true
+	}
+	rs, err := NewClusterRediStore(cluster)
+	if err != nil {
+		t.Fatalf("can't create redistore, returned %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	authID := storagetest.GenerateSessionId()
+	for i := 0; i < 10; i++ {
+		sess := storagetest.CloneSession(storagetest.GenerateSession(false), authID)
+		if err = rs.InsertContext(ctx, sess); err != nil {
+			t.Fatalf("InsertContext returned error: %v", err)
+		}
+		if err = rs.TouchContext(ctx, sess.ID, time.Now().UTC(), 60); err != nil {
+			t.Fatalf("TouchContext returned error: %v", err)
+		}
+		if err = rs.ReplaceContext(ctx, sess); err != nil {
+			t.Fatalf("ReplaceContext returned error: %v", err)
+		}
+		delta := &sersan.SessionDelta{ID: sess.ID, Updated: map[interface{}]interface{}{"foo": "bar"}}
+		if err = rs.ApplyDeltaContext(ctx, delta, 60); err != nil {
+			t.Fatalf("ApplyDeltaContext returned error: %v", err)
+		}
+		if i%2 == 0 {
+			err = rs.AliasContext(ctx, sess.ID, authID, 60)
+		} else {
+			err = rs.DestroyContext(ctx, sess.ID)
+		}
+		if err != nil {
+			t.Fatalf("AliasContext or DestroyContext returned error: %v", err)
+		}
+	}
+	if _, err = rs.PruneAuthIndexesContext(ctx); err != nil {
+		t.Fatalf("PruneAuthIndexesContext returned error: %v", err)
+	}
+
+	assertKeysOnTheirNode(t, servers)
+}
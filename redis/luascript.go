@@ -4,13 +4,33 @@ import (
 	"github.com/gomodule/redigo/redis"
 )
 
-// Lua script for inserting session
+// The scripts below run on a standalone Redis server. The scripts updating an
+// existing session read its auth ID and derive the key of its auth set from the
+// given prefix, so a single round trip keeps the auth sets in sync with concurrent
+// writes. As that key can't be declared in KEYS, the scripts used on Redis Cluster
+// are in cluster_luascript.go.
+
+// Lua function extending the expiration of an auth set, so it lives at least as
+// long as the sessions it holds
+const extendExpireFunc = `
+	local function extendExpire(key, expire)
+		if(expire ~= '' and redis.call('TTL', key) < tonumber(expire)) then
+			redis.call('EXPIRE', key, expire)
+		end
+	end
+`
+
+// Lua script for inserting session, returns 0 if the session already exists
 //
 // KEYS[1] - session's ID
 // KEYS[2] - Auth key
 // ARGV[1] - Expiration in seconds
 // ARGV... - Session Data
-var insertScript = redis.NewScript(2, `
+var insertScript = redis.NewScript(2, extendExpireFunc+`
+	if(redis.call('EXISTS', KEYS[1]) == 1) then
+		return 0
+	end
+
 	-- now insert session data
 	local sessions = {}
 	for i = 2, #ARGV, 1 do
@@ -25,38 +45,202 @@ var insertScript = redis.NewScript(2, `
 
 	if(KEYS[2] ~= '') then
 		redis.call('SADD', KEYS[2], KEYS[1])
+		extendExpire(KEYS[2], ARGV[1])
 	end
 
-	return true
+	return 1
 `)
 
-// Lua script for replace/update session
+// Lua script for replace/update session, returns -1 if the session doesn't exist
+// and 0 if its version isn't the expected one
 //
 // KEYS[1] - Session ID
-// KEYS[2] - Current auth key
-// KEYS[3] - Old auth key
-// ARGV[1] - expiration in second
+// KEYS[2] - New auth key
+// ARGV[1] - Auth key prefix
+// ARGV[2] - expiration in second
+// ARGV[3] - expected version of the session, empty to replace it unconditionally
 // ARGV... - session data
-var replaceScript = redis.NewScript(3, `
+var replaceScript = redis.NewScript(2, extendExpireFunc+`
+	local oldAuthID = redis.call('HGET', KEYS[1], 'AuthID')
+	if(not oldAuthID) then
+		return -1
+	end
+	if(ARGV[3] ~= '') then
+		local version = redis.call('HGET', KEYS[1], 'Version') or '0'
+		if(tonumber(version) ~= tonumber(ARGV[3])) then
+			return 0
+		end
+	end
+
 	redis.call('DEL', KEYS[1])
 	local sessions = {}
-	for i = 2, #ARGV, 1 do
+	for i = 4, #ARGV, 1 do
 		sessions[#sessions + 1] = ARGV[i]
 	end
 	redis.call('HMSET', KEYS[1], unpack(sessions))
 	-- expire if needed
-	if(ARGV[1] ~= '') then
-		redis.call('EXPIRE', KEYS[1], ARGV[1])
+	if(ARGV[2] ~= '') then
+		redis.call('EXPIRE', KEYS[1], ARGV[2])
 	end
 	-- if old authID is not equal with new one, replace that
-	if(KEYS[2] ~= KEYS[3]) then
-		if(KEYS[3] ~= '') then
-			redis.call('SREM', KEYS[3], KEYS[1])
+	local oldAuthKey = ''
+	if(oldAuthID ~= '') then
+		oldAuthKey = ARGV[1] .. oldAuthID
+	end
+	if(KEYS[2] ~= oldAuthKey) then
+		if(oldAuthKey ~= '') then
+			redis.call('SREM', oldAuthKey, KEYS[1])
 		end
 		if(KEYS[2] ~= '') then
 			redis.call('SADD', KEYS[2], KEYS[1])
 		end
 	end
+	if(KEYS[2] ~= '') then
+		extendExpire(KEYS[2], ARGV[2])
+	end
+
+	return 1
+`)
+
+// Lua script for destroying a session
+//
+// KEYS[1] - Session ID
+// ARGV[1] - Auth key prefix
+var destroyScript = redis.NewScript(1, `
+	local authID = redis.call('HGET', KEYS[1], 'AuthID')
+	if(authID and authID ~= '') then
+		redis.call('SREM', ARGV[1] .. authID, KEYS[1])
+	end
+	redis.call('DEL', KEYS[1])
 
 	return true
 `)
+
+// Lua script for updating the access time of a session, returns false if the
+// session doesn't exist
+//
+// KEYS[1] - Session ID
+// ARGV[1] - Auth key prefix
+// ARGV[2] - expiration in second
+// ARGV[3] - access time
+var touchScript = redis.NewScript(1, extendExpireFunc+`
+	local authID = redis.call('HGET', KEYS[1], 'AuthID')
+	if(not authID) then
+		return false
+	end
+	redis.call('HSET', KEYS[1], 'AccessedAt', ARGV[3])
+	redis.call('EXPIRE', KEYS[1], ARGV[2])
+	if(authID ~= '') then
+		extendExpire(ARGV[1] .. authID, ARGV[2])
+	end
+
+	return 1
+`)
+
+// Lua script for destroying the given sessions if they belong to the auth ID, and
+// removing them from its auth set.
+//
+// KEYS[1] - Auth key
+// KEYS... - Session keys
+// ARGV[1] - Auth ID
+var destroyExceptScript = redis.NewScript(-1, `
+	for i = 2, #KEYS, 1 do
+		if(redis.call('HGET', KEYS[i], 'AuthID') == ARGV[1]) then
+			redis.call('DEL', KEYS[i])
+		end
+		redis.call('SREM', KEYS[1], KEYS[i])
+	end
+
+	return true
+`)
+
+// Lua script for removing the given sessions from an auth set if they expired, or
+// belong to another auth ID. Returns the number of removed sessions.
+//
+// KEYS[1] - Auth key
+// KEYS... - Session keys
+// ARGV[1] - Auth ID
+var pruneScript = redis.NewScript(-1, `
+	local removed = 0
+	for i = 2, #KEYS, 1 do
+		if(redis.call('HGET', KEYS[i], 'AuthID') ~= ARGV[1]) then
+			removed = removed + redis.call('SREM', KEYS[1], KEYS[i])
+		end
+	end
+
+	return removed
+`)
+
+// Lua script for destroying a session and keeping its ID as an alias of another
+// session, returns false if the session doesn't exist
+//
+// KEYS[1] - Session ID
+// KEYS[2] - Alias key
+// ARGV[1] - Auth key prefix
+// ARGV[2] - Target session ID
+// ARGV[3] - expiration of the alias in second
+var aliasScript = redis.NewScript(2, `
+	local authID = redis.call('HGET', KEYS[1], 'AuthID')
+	if(not authID) then
+		return false
+	end
+	if(authID ~= '') then
+		redis.call('SREM', ARGV[1] .. authID, KEYS[1])
+	end
+	redis.call('DEL', KEYS[1])
+	redis.call('SET', KEYS[2], ARGV[2], 'EX', ARGV[3])
+
+	return 1
+`)
+
+// Lua script for applying the changes made to a session, returns the number of
+// value fields of the session or false if it doesn't exist
+//
+// KEYS[1] - Session ID
+// ARGV[1] - Auth key prefix
+// ARGV[2] - expiration in second
+// ARGV... - fields to set
+var deltaScript = redis.NewScript(1, extendExpireFunc+`
+	local authID = redis.call('HGET', KEYS[1], 'AuthID')
+	if(not authID) then
+		return false
+	end
+	local fields = {}
+	for i = 3, #ARGV, 1 do
+		fields[#fields + 1] = ARGV[i]
+	end
+	redis.call('HMSET', KEYS[1], unpack(fields))
+	redis.call('HINCRBY', KEYS[1], 'Version', 1)
+	redis.call('EXPIRE', KEYS[1], ARGV[2])
+	if(authID ~= '') then
+		extendExpire(ARGV[1] .. authID, ARGV[2])
+	end
+	local count = 0
+	for _, field in ipairs(redis.call('HKEYS', KEYS[1])) do
+		if(string.sub(field, 1, 2) == 'v:') then
+			count = count + 1
+		end
+	end
+
+	return count
+`)
+
+// Lua script for folding the value fields of a session into its Values field, if
+// the session wasn't modified since it was read. It only accesses the session key,
+// so it's also used on Redis Cluster.
+//
+// KEYS[1] - Session ID
+// ARGV[1] - Version of the session when it was read
+// ARGV[2] - Values of the session, with the value fields applied
+// ARGV... - value fields to delete
+var foldScript = redis.NewScript(1, `
+	if((redis.call('HGET', KEYS[1], 'Version') or '0') ~= ARGV[1]) then
+		return 0
+	end
+	redis.call('HSET', KEYS[1], 'Values', ARGV[2])
+	for i = 3, #ARGV, 1 do
+		redis.call('HDEL', KEYS[1], ARGV[i])
+	end
+
+	return 1
+`)
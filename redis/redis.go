@@ -1,6 +1,9 @@
 package redis
 
 import (
+	"context"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
@@ -11,13 +14,27 @@ import (
 // 30 days
 const defaultSessionExpire = 86400 * 30
 
+// Prefix of the hash fields holding the values saved by ApplyDelta, they override
+// the values in the Values field. An empty field is a deleted value.
+const valueFieldPrefix = "v:"
+
+// Number of value fields from which ApplyDelta folds them into the Values field,
+// so the hash doesn't grow with every key ever modified
+const maxValueFields = 16
+
 // RedisStore implements serssan.Store using Redis backend, via `redigo` library.
+// It also implements sersan.StorageContext, honoring cancellation through redigo's
+// context-aware connection APIs.
+//
+// Use NewClusterRediStore to run on Redis Cluster.
 type RediStore struct {
+	// Pool of the Redis server, nil on Redis Cluster
 	Pool                         *redis.Pool
 	DefaultExpire                int
 	keyPrefix                    string
 	serializer                   SessionSerializer
 	IdleTimeout, AbsoluteTimeout int
+	cluster                      *ClusterPool
 }
 
 func (rs *RediStore) SetKeyPrefix(p string) {
@@ -38,6 +55,15 @@ type SessionHash struct {
 	CreatedAt string
 	// When this session was last accessed in UTC
 	AccessedAt string
+	// Session's metadata, see sersan.Metadata
+	IP         string
+	LastSeenIP string
+	UserAgent  string
+	Label      string
+	// Session's binding, see sersan.Binder
+	Binding string
+	// Session's version, see sersan.VersionReplacer
+	Version int64
 }
 
 func newSessionHashFrom(sess *sersan.Session, serializer SessionSerializer) (*SessionHash, error) {
@@ -46,6 +72,12 @@ func newSessionHashFrom(sess *sersan.Session, serializer SessionSerializer) (*Se
 	sh.AuthID = sess.AuthID
 	sh.CreatedAt = sess.CreatedAt.Format(time.UnixDate)
 	sh.AccessedAt = sess.AccessedAt.Format(time.UnixDate)
+	sh.IP = sess.Metadata.IP
+	sh.LastSeenIP = sess.Metadata.LastSeenIP
+	sh.UserAgent = sess.Metadata.UserAgent
+	sh.Label = sess.Metadata.Label
+	sh.Binding = sess.Binding
+	sh.Version = sess.Version
 
 	bytes, err := serializer.Serialize(sess)
 	if err != nil {
@@ -77,33 +109,64 @@ func (sh *SessionHash) toSession(id string, serializer SessionSerializer) (*sers
 
 	sess.ID = id
 	sess.AuthID = sh.AuthID
+	sess.Metadata = sersan.Metadata{
+		IP:         sh.IP,
+		LastSeenIP: sh.LastSeenIP,
+		UserAgent:  sh.UserAgent,
+		Label:      sh.Label,
+	}
+	sess.Binding = sh.Binding
+	sess.Version = sh.Version
 
 	return sess, nil
 }
 
 // NewRediStore instantiates a RediStore with provided redis.Pool
 func NewRediStore(pool *redis.Pool) (*RediStore, error) {
-	rs := &RediStore{
-		Pool:            pool,
+	rs := newRediStore()
+	rs.Pool = pool
+	_, err := rs.ping()
+	return rs, err
+}
+
+// NewClusterRediStore instantiates a RediStore running on a Redis Cluster.
+//
+// The keys of a session are tagged with the session ID, so a session lives on a
+// single node, and each auth set is tagged with its auth ID. As the auth sets live
+// on other nodes than their sessions, they are updated after the sessions rather
+// than atomically. ListByAuthId, DestroyAllOfAuthId and DestroyByAuthIdExcept
+// ignore the sessions that no longer belong to the auth ID, and PruneAuthIndexes
+// removes them from the auth sets. The key prefix must not contain braces.
+func NewClusterRediStore(cluster *ClusterPool) (*RediStore, error) {
+	rs := newRediStore()
+	rs.cluster = cluster
+	_, err := rs.ping()
+	return rs, err
+}
+
+func newRediStore() *RediStore {
+	return &RediStore{
 		DefaultExpire:   604800,
 		IdleTimeout:     604800,  // 7 days
 		AbsoluteTimeout: 5184000, // 60 days
 		keyPrefix:       "sersan:redis:",
 		serializer:      GobSerializer{},
 	}
-	_, err := rs.ping()
-	return rs, err
 }
 
 func (rs *RediStore) Get(id string) (*sersan.Session, error) {
-	conn := rs.Pool.Get()
-	defer conn.Close()
+	return rs.GetContext(context.Background(), id)
+}
 
-	if err := conn.Err(); err != nil {
+func (rs *RediStore) GetContext(ctx context.Context, id string) (*sersan.Session, error) {
+	sk := rs.sessionKey(id)
+	conn, err := rs.getConn(ctx, sk)
+	if err != nil {
 		return nil, err
 	}
+	defer conn.Close()
 
-	data, err := redis.Values(conn.Do("HGETALL", rs.keyPrefix+id))
+	data, err := redis.Values(redis.DoContext(conn, ctx, "HGETALL", sk))
 	if err != nil {
 		return nil, err
 	}
@@ -112,135 +175,774 @@ func (rs *RediStore) Get(id string) (*sersan.Session, error) {
 		return nil, nil
 	}
 
+	return rs.sessionFromHash(id, data)
+}
+
+// Builds the session from the result of HGETALL.
+func (rs *RediStore) sessionFromHash(id string, data []interface{}) (*sersan.Session, error) {
 	var sh = new(SessionHash)
-	if err = redis.ScanStruct(data, sh); err != nil {
+	if err := redis.ScanStruct(data, sh); err != nil {
+		return nil, err
+	}
+	sess, err := sh.toSession(id, rs.serializer)
+	if err != nil {
 		return nil, err
 	}
 
-	return sh.toSession(id, rs.serializer)
+	for i := 0; i+1 < len(data); i += 2 {
+		field, _ := redis.String(data[i], nil)
+		if !strings.HasPrefix(field, valueFieldPrefix) {
+			continue
+		}
+		key := strings.TrimPrefix(field, valueFieldPrefix)
+		b, _ := redis.Bytes(data[i+1], nil)
+		if len(b) == 0 {
+			delete(sess.Values, key)
+			continue
+		}
+
+		vsess := sersan.NewSession(id, "", time.Time{})
+		if err = rs.serializer.Deserialize(b, vsess); err != nil {
+			return nil, err
+		}
+		sess.Values[key] = vsess.Values[key]
+	}
+
+	return sess, nil
 }
 
 func (rs *RediStore) Destroy(id string) error {
-	conn := rs.Pool.Get()
-	defer conn.Close()
+	return rs.DestroyContext(context.Background(), id)
+}
 
-	if err := conn.Err(); err != nil {
-		return err
+func (rs *RediStore) DestroyContext(ctx context.Context, id string) error {
+	sk := rs.sessionKey(id)
+	if rs.cluster == nil {
+		return rs.doKey(ctx, sk, func(conn redis.Conn) error {
+			_, err := destroyScript.DoContext(ctx, conn, sk, rs.authKeyPrefix())
+			return err
+		})
 	}
 
-	sk := rs.keyPrefix + id
-	authID, err := redis.String(conn.Do("HGET", sk, "AuthID"))
+	var authID string
+	err := rs.doKey(ctx, sk, func(conn redis.Conn) error {
+		var err error
+		authID, err = redis.String(clusterDestroyScript.DoContext(ctx, conn, sk))
+		return err
+	})
+	if err == redis.ErrNil {
+		return nil
+	}
 	if err != nil {
-		if err == redis.ErrNil {
-			return nil
-		}
 		return err
 	}
+	return rs.removeFromIndex(ctx, authID, sk)
+}
+
+func (rs *RediStore) DestroyAllOfAuthId(authId string) error {
+	return rs.DestroyAllOfAuthIdContext(context.Background(), authId)
+}
+
+func (rs *RediStore) DestroyAllOfAuthIdContext(ctx context.Context, authId string) error {
+	return rs.destroyByAuthIdExcept(ctx, authId, "")
+}
+
+// ListByAuthId implements sersan.AuthIndex, using the set of session keys kept for
+// every auth ID.
+func (rs *RediStore) ListByAuthId(authId string) ([]*sersan.Session, error) {
+	return rs.ListByAuthIdContext(context.Background(), authId)
+}
+
+func (rs *RediStore) ListByAuthIdContext(ctx context.Context, authId string) ([]*sersan.Session, error) {
+	sessions := []*sersan.Session{}
+	if authId == "" {
+		return sessions, nil
+	}
 
-	conn.Send("MULTI")
-	err = conn.Send("DEL", sk)
-	if authID != "" {
-		conn.Send("SREM", rs.authKey(authID), sk)
+	keys, err := rs.authMembers(ctx, authId)
+	if err != nil || len(keys) == 0 {
+		return sessions, err
 	}
-	_, err = conn.Do("EXEC")
-	return err
+
+	hashes, err := rs.getAll(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	for i, data := range hashes {
+		// the session expired, but it's still in the set
+		if len(data) == 0 {
+			continue
+		}
+
+		sess, err := rs.sessionFromHash(rs.sessionID(keys[i]), data)
+		if err != nil {
+			return nil, err
+		}
+		// the session was moved to another auth ID, but it's still in the set
+		if sess.AuthID != authId {
+			continue
+		}
+		sessions = append(sessions, sess)
+	}
+
+	return sessions, nil
 }
 
-func (rs *RediStore) DestroyAllOfAuthId(authId string) error {
-	conn := rs.Pool.Get()
+// Runs HGETALL on the given keys, pipelined when they're on a single server.
+func (rs *RediStore) getAll(ctx context.Context, keys []string) ([][]interface{}, error) {
+	hashes := make([][]interface{}, len(keys))
+	if rs.cluster != nil {
+		for i, key := range keys {
+			conn, err := rs.getConn(ctx, key)
+			if err != nil {
+				return nil, err
+			}
+			hashes[i], err = redis.Values(redis.DoContext(conn, ctx, "HGETALL", key))
+			conn.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return hashes, nil
+	}
+
+	conn, err := rs.Pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
 	defer conn.Close()
 
-	if err := conn.Err(); err != nil {
+	for _, key := range keys {
+		if err = conn.Send("HGETALL", key); err != nil {
+			return nil, err
+		}
+	}
+	if err = conn.Flush(); err != nil {
+		return nil, err
+	}
+	for i := range keys {
+		if hashes[i], err = redis.Values(redis.ReceiveContext(conn, ctx)); err != nil {
+			return nil, err
+		}
+	}
+
+	return hashes, nil
+}
+
+// DestroyByAuthIdExcept implements sersan.AuthIndex.
+func (rs *RediStore) DestroyByAuthIdExcept(authId, keepId string) error {
+	return rs.DestroyByAuthIdExceptContext(context.Background(), authId, keepId)
+}
+
+func (rs *RediStore) DestroyByAuthIdExceptContext(ctx context.Context, authId, keepId string) error {
+	return rs.destroyByAuthIdExcept(ctx, authId, rs.sessionKey(keepId))
+}
+
+// Destroys the sessions of the auth ID, except the one with the given key. Only
+// the sessions still belonging to the auth ID are destroyed.
+func (rs *RediStore) destroyByAuthIdExcept(ctx context.Context, authId, keepKey string) error {
+	if authId == "" {
+		return nil
+	}
+
+	if rs.cluster == nil {
+		return rs.destroyMembersExcept(ctx, authId, keepKey)
+	}
+
+	keys, err := rs.authMembers(ctx, authId)
+	if err != nil {
 		return err
 	}
+	for _, sk := range keys {
+		if sk == keepKey {
+			continue
+		}
+		if err = rs.doKey(ctx, sk, func(conn redis.Conn) error {
+			_, err := destroyIfAuthScript.DoContext(ctx, conn, sk, authId)
+			return err
+		}); err != nil {
+			return err
+		}
+		if err = rs.removeFromIndex(ctx, authId, sk); err != nil {
+			return err
+		}
+	}
 
-	authKey := rs.authKey(authId)
-	sessionIDs, err := redis.Strings(conn.Do("SMEMBERS", authKey))
+	return nil
+}
+
+// Destroys the sessions of the auth set except the one with the given key, on a
+// standalone server. The members are destroyed atomically by a script declaring
+// them, again if sessions were added to the set meanwhile.
+func (rs *RediStore) destroyMembersExcept(ctx context.Context, authId, keepKey string) error {
+	conn, err := rs.Pool.GetContext(ctx)
 	if err != nil {
 		return err
 	}
-	_, err = conn.Do("DEL", redis.Args{}.Add(authKey).AddFlat(sessionIDs)...)
+	defer conn.Close()
 
-	return err
+	authKey := rs.authKey(authId)
+	for {
+		keys, err := redis.Strings(redis.DoContext(conn, ctx, "SMEMBERS", authKey))
+		if err != nil {
+			return err
+		}
+		args := redis.Args{}.Add(0, authKey)
+		for _, sk := range keys {
+			if sk != keepKey {
+				args = args.Add(sk)
+			}
+		}
+		if len(args) == 2 {
+			return nil
+		}
+		args[0] = len(args) - 1
+		if _, err = destroyExceptScript.DoContext(ctx, conn, append(args, authId)...); err != nil {
+			return err
+		}
+	}
+}
+
+// PruneAuthIndex removes the sessions which expired, or no longer belong to the auth
+// ID, from the set of sessions of the given auth ID. Returns the number of removed
+// sessions.
+func (rs *RediStore) PruneAuthIndex(authId string) (int, error) {
+	return rs.PruneAuthIndexContext(context.Background(), authId)
+}
+
+func (rs *RediStore) PruneAuthIndexContext(ctx context.Context, authId string) (int, error) {
+	if authId == "" {
+		return 0, nil
+	}
+
+	keys, err := rs.authMembers(ctx, authId)
+	if err != nil || len(keys) == 0 {
+		return 0, err
+	}
+	if rs.cluster == nil {
+		conn, err := rs.Pool.GetContext(ctx)
+		if err != nil {
+			return 0, err
+		}
+		defer conn.Close()
+
+		args := redis.Args{}.Add(len(keys)+1, rs.authKey(authId)).AddFlat(keys).Add(authId)
+		return redis.Int(pruneScript.DoContext(ctx, conn, args...))
+	}
+
+	removed := 0
+	for _, sk := range keys {
+		var owner string
+		if err = rs.doKey(ctx, sk, func(conn redis.Conn) error {
+			var err error
+			owner, err = redis.String(redis.DoContext(conn, ctx, "HGET", sk, "AuthID"))
+			if err == redis.ErrNil {
+				return nil
+			}
+			return err
+		}); err != nil {
+			return removed, err
+		}
+		if owner == authId {
+			continue
+		}
+		if err = rs.removeFromIndex(ctx, authId, sk); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+// PruneAuthIndexes runs PruneAuthIndex on the sets of all the auth IDs, iterating
+// them with SCAN. It's meant to be run periodically, e.g. by a cron job, and returns
+// the total number of removed sessions.
+func (rs *RediStore) PruneAuthIndexes() (int, error) {
+	return rs.PruneAuthIndexesContext(context.Background())
+}
+
+func (rs *RediStore) PruneAuthIndexesContext(ctx context.Context) (int, error) {
+	removed := 0
+	for _, pool := range rs.pools() {
+		n, err := rs.pruneAuthIndexesOf(ctx, pool)
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+	}
+
+	return removed, nil
+}
+
+// Prunes the auth sets stored on the server of the given pool. The connection
+// used by SCAN is released before pruning, which takes connections from the pool.
+func (rs *RediStore) pruneAuthIndexesOf(ctx context.Context, pool *redis.Pool) (int, error) {
+	pattern := escapeGlob(rs.authKeyPrefix()) + "*"
+	removed, cursor := 0, 0
+	for {
+		conn, err := pool.GetContext(ctx)
+		if err != nil {
+			return removed, err
+		}
+		values, err := redis.Values(redis.DoContext(conn, ctx, "SCAN", cursor, "MATCH", pattern, "COUNT", 100))
+		conn.Close()
+		if err != nil {
+			return removed, err
+		}
+		var keys []string
+		if _, err = redis.Scan(values, &cursor, &keys); err != nil {
+			return removed, err
+		}
+
+		for _, key := range keys {
+			n, err := rs.PruneAuthIndexContext(ctx, rs.authIDFromKey(key))
+			if err != nil {
+				return removed, err
+			}
+			removed += n
+		}
+
+		if cursor == 0 {
+			return removed, nil
+		}
+	}
 }
 
 func (rs *RediStore) Insert(sess *sersan.Session) error {
-	conn := rs.Pool.Get()
-	defer conn.Close()
+	return rs.InsertContext(context.Background(), sess)
+}
 
-	if err := conn.Err(); err != nil {
+func (rs *RediStore) InsertContext(ctx context.Context, sess *sersan.Session) error {
+	sk := rs.sessionKey(sess.ID)
+	sh, err := newSessionHashFrom(sess, rs.serializer)
+	if err != nil {
 		return err
 	}
 
-	sk := rs.keyPrefix + sess.ID
-	exist, err := redis.Bool(conn.Do("EXISTS", sk, "AuthID"))
+	// the existence check is done by the script, so concurrent inserts of the same
+	// session ID can't both succeed
+	expire := rs.getExpire(sess)
+	var inserted bool
+	err = rs.doKey(ctx, sk, func(conn redis.Conn) error {
+		var err error
+		if rs.cluster != nil {
+			args := redis.Args{}.Add(sk, expire).AddFlat(sh)
+			inserted, err = redis.Bool(clusterInsertScript.DoContext(ctx, conn, args...))
+		} else {
+			args := redis.Args{}.Add(sk, rs.authKey(sess.AuthID), expire).AddFlat(sh)
+			inserted, err = redis.Bool(insertScript.DoContext(ctx, conn, args...))
+		}
+		return err
+	})
 	if err != nil {
 		return err
 	}
-	if exist {
+	if !inserted {
 		return sersan.SessionAlreadyExists{ID: sess.ID}
 	}
 
+	return rs.addToIndex(ctx, sess.AuthID, sk, expire)
+}
+
+func (rs *RediStore) Replace(sess *sersan.Session) error {
+	return rs.ReplaceContext(context.Background(), sess)
+}
+
+func (rs *RediStore) ReplaceContext(ctx context.Context, sess *sersan.Session) error {
+	_, err := rs.replace(ctx, sess, "")
+	return err
+}
+
+// ReplaceIfVersion implements sersan.VersionReplacer, comparing the versions in
+// the same script replacing the session.
+func (rs *RediStore) ReplaceIfVersion(sess *sersan.Session, version int64) error {
+	return rs.ReplaceIfVersionContext(context.Background(), sess, version)
+}
+
+func (rs *RediStore) ReplaceIfVersionContext(ctx context.Context, sess *sersan.Session, version int64) error {
+	replaced, err := rs.replace(ctx, sess, version)
+	if err != nil {
+		return err
+	}
+	if !replaced {
+		return sersan.SessionVersionConflict{ID: sess.ID}
+	}
+
+	return nil
+}
+
+// Replaces the session if its version is equal to version, or unconditionally if
+// version is an empty string.
+func (rs *RediStore) replace(ctx context.Context, sess *sersan.Session, version interface{}) (bool, error) {
+	sk := rs.sessionKey(sess.ID)
 	sh, err := newSessionHashFrom(sess, rs.serializer)
 	if err != nil {
+		return false, err
+	}
+	expire := rs.getExpire(sess)
+
+	// the old auth ID is read by the script, so the auth sets can't get out of
+	// sync with concurrent writes
+	var (
+		replaced  int
+		oldAuthID string
+	)
+	err = rs.doKey(ctx, sk, func(conn redis.Conn) error {
+		if rs.cluster == nil {
+			args := redis.Args{}.Add(sk, rs.authKey(sess.AuthID), rs.authKeyPrefix(), expire, version).AddFlat(sh)
+			var err error
+			replaced, err = redis.Int(replaceScript.DoContext(ctx, conn, args...))
+			return err
+		}
+
+		args := redis.Args{}.Add(sk, expire, version).AddFlat(sh)
+		values, err := redis.Values(clusterReplaceScript.DoContext(ctx, conn, args...))
+		if err != nil {
+			return err
+		}
+		_, err = redis.Scan(values, &replaced, &oldAuthID)
 		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	if replaced < 0 {
+		return false, sersan.SessionDoesNotExist{ID: sess.ID}
+	}
+	if replaced == 0 {
+		return false, nil
+	}
+
+	if oldAuthID != sess.AuthID {
+		if err = rs.removeFromIndex(ctx, oldAuthID, sk); err != nil {
+			return true, err
+		}
+	}
+	return true, rs.addToIndex(ctx, sess.AuthID, sk, expire)
+}
+
+// Touch implements sersan.Toucher, updating the access time and expiration of
+// the session without rewriting its data.
+func (rs *RediStore) Touch(id string, accessedAt time.Time, expire int) error {
+	return rs.TouchContext(context.Background(), id, accessedAt, expire)
+}
+
+func (rs *RediStore) TouchContext(ctx context.Context, id string, accessedAt time.Time, expire int) error {
+	sk := rs.sessionKey(id)
+	if expire <= 0 {
+		expire = rs.DefaultExpire
 	}
 
-	args := redis.Args{}.Add(sk).Add(rs.authKey(sess.AuthID))
-	args = args.Add(rs.getExpire(sess)).AddFlat(sh)
-	_, err = insertScript.Do(conn, args...)
+	at := accessedAt.Format(time.UnixDate)
+	var authID string
+	err := rs.doKey(ctx, sk, func(conn redis.Conn) error {
+		var err error
+		if rs.cluster == nil {
+			_, err = redis.Int(touchScript.DoContext(ctx, conn, sk, rs.authKeyPrefix(), expire, at))
+		} else {
+			authID, err = redis.String(clusterTouchScript.DoContext(ctx, conn, sk, expire, at))
+		}
+		return err
+	})
+	if err == redis.ErrNil {
+		return sersan.SessionDoesNotExist{ID: id}
+	}
 	if err != nil {
 		return err
 	}
-	return nil
+
+	return rs.addToIndex(ctx, authID, sk, expire)
 }
 
-func (rs *RediStore) Replace(sess *sersan.Session) error {
-	conn := rs.Pool.Get()
-	defer conn.Close()
+// ApplyDelta implements sersan.DeltaStorage. Each value of the delta is saved in its
+// own hash field, so the keys of the session values must be strings.
+func (rs *RediStore) ApplyDelta(delta *sersan.SessionDelta, expire int) error {
+	return rs.ApplyDeltaContext(context.Background(), delta, expire)
+}
 
-	if err := conn.Err(); err != nil {
+func (rs *RediStore) ApplyDeltaContext(ctx context.Context, delta *sersan.SessionDelta, expire int) error {
+	if expire <= 0 {
+		expire = rs.DefaultExpire
+	}
+
+	sk := rs.sessionKey(delta.ID)
+	var args redis.Args
+	for k, v := range delta.Updated {
+		ks, ok := k.(string)
+		if !ok {
+			return fmt.Errorf("sersan/redis: non-string key of session value: %v", k)
+		}
+		b, err := rs.serializer.Serialize(&sersan.Session{Values: map[interface{}]interface{}{k: v}})
+		if err != nil {
+			return err
+		}
+		args = args.Add(valueFieldPrefix+ks, b)
+	}
+	for _, k := range delta.Deleted {
+		ks, ok := k.(string)
+		if !ok {
+			return fmt.Errorf("sersan/redis: non-string key of session value: %v", k)
+		}
+		args = args.Add(valueFieldPrefix+ks, "")
+	}
+	args = args.Add("AccessedAt", delta.AccessedAt.Format(time.UnixDate))
+	args = args.Add("LastSeenIP", delta.Metadata.LastSeenIP, "IP", delta.Metadata.IP)
+	args = args.Add("UserAgent", delta.Metadata.UserAgent, "Label", delta.Metadata.Label)
+	args = args.Add("Binding", delta.Binding)
+
+	var authID string
+	err := rs.doKey(ctx, sk, func(conn redis.Conn) error {
+		var (
+			fields int
+			err    error
+		)
+		if rs.cluster == nil {
+			kargs := redis.Args{}.Add(sk, rs.authKeyPrefix(), expire)
+			fields, err = redis.Int(deltaScript.DoContext(ctx, conn, append(kargs, args...)...))
+		} else {
+			var values []interface{}
+			values, err = redis.Values(clusterDeltaScript.DoContext(ctx, conn, append(redis.Args{}.Add(sk, expire), args...)...))
+			if err == nil {
+				_, err = redis.Scan(values, &authID, &fields)
+			}
+		}
+		if err != nil || fields < maxValueFields {
+			return err
+		}
+		return rs.foldValues(ctx, conn, delta.ID, sk)
+	})
+	if err == redis.ErrNil {
+		return sersan.SessionDoesNotExist{ID: delta.ID}
+	}
+	if err != nil {
 		return err
 	}
 
-	sk := rs.keyPrefix + sess.ID
-	oldAuthID, err := redis.String(conn.Do("HGET", sk, "AuthID"))
+	return rs.addToIndex(ctx, authID, sk, expire)
+}
+
+// Folds the value fields of the session into its Values field. Nothing is written
+// if the session is modified meanwhile, the next delta folds them then.
+func (rs *RediStore) foldValues(ctx context.Context, conn redis.Conn, id, sk string) error {
+	data, err := redis.Values(redis.DoContext(conn, ctx, "HGETALL", sk))
+	if err != nil || len(data) == 0 {
+		return err
+	}
+	sess, err := rs.sessionFromHash(id, data)
 	if err != nil {
-		if err == redis.ErrNil {
-			return sersan.SessionDoesNotExist{ID: sess.ID}
+		return err
+	}
+	b, err := rs.serializer.Serialize(sess)
+	if err != nil {
+		return err
+	}
+
+	args := redis.Args{}.Add(sk, sess.Version, b)
+	for i := 0; i < len(data); i += 2 {
+		if field, _ := redis.String(data[i], nil); strings.HasPrefix(field, valueFieldPrefix) {
+			args = args.Add(field)
+		}
+	}
+	_, err = foldScript.DoContext(ctx, conn, args...)
+	return err
+}
+
+// Alias implements sersan.Aliaser, destroying the session and keeping its ID in
+// a key expiring after ttl seconds. The alias is only created if the session
+// exists, so an alias isn't overwritten.
+func (rs *RediStore) Alias(id, targetId string, ttl int) error {
+	return rs.AliasContext(context.Background(), id, targetId, ttl)
+}
+
+func (rs *RediStore) AliasContext(ctx context.Context, id, targetId string, ttl int) error {
+	sk := rs.sessionKey(id)
+	if ttl <= 0 {
+		ttl = 1
+	}
+
+	ak := rs.aliasKey(id)
+	var authID string
+	err := rs.doKey(ctx, sk, func(conn redis.Conn) error {
+		var err error
+		if rs.cluster == nil {
+			_, err = redis.Int(aliasScript.DoContext(ctx, conn, sk, ak, rs.authKeyPrefix(), targetId, ttl))
+		} else {
+			authID, err = redis.String(clusterAliasScript.DoContext(ctx, conn, sk, ak, targetId, ttl))
 		}
 		return err
+	})
+	if err == redis.ErrNil {
+		return sersan.SessionDoesNotExist{ID: id}
+	}
+	if err != nil {
+		return err
 	}
 
-	sh, err := newSessionHashFrom(sess, rs.serializer)
+	return rs.removeFromIndex(ctx, authID, sk)
+}
+
+func (rs *RediStore) ResolveAlias(id string) (string, error) {
+	return rs.ResolveAliasContext(context.Background(), id)
+}
+
+func (rs *RediStore) ResolveAliasContext(ctx context.Context, id string) (string, error) {
+	ak := rs.aliasKey(id)
+	conn, err := rs.getConn(ctx, ak)
 	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	target, err := redis.String(redis.DoContext(conn, ctx, "GET", ak))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+
+	return target, err
+}
+
+// Returns the session keys in the set of the auth ID.
+func (rs *RediStore) authMembers(ctx context.Context, authId string) ([]string, error) {
+	authKey := rs.authKey(authId)
+	conn, err := rs.getConn(ctx, authKey)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return redis.Strings(redis.DoContext(conn, ctx, "SMEMBERS", authKey))
+}
+
+// Adds the session key to the set of the auth ID on Redis Cluster, the scripts do
+// it otherwise.
+func (rs *RediStore) addToIndex(ctx context.Context, authId, sk string, expire int) error {
+	if rs.cluster == nil || authId == "" {
+		return nil
+	}
+
+	authKey := rs.authKey(authId)
+	return rs.doKey(ctx, authKey, func(conn redis.Conn) error {
+		_, err := indexAddScript.DoContext(ctx, conn, authKey, sk, expire)
 		return err
+	})
+}
+
+// Removes the session key from the set of the auth ID on Redis Cluster, the scripts
+// do it otherwise.
+func (rs *RediStore) removeFromIndex(ctx context.Context, authId, sk string) error {
+	if rs.cluster == nil || authId == "" {
+		return nil
 	}
-	args := redis.Args{}.Add(sk).Add(rs.authKey(sess.AuthID))
-	args = args.Add(rs.authKey(oldAuthID)).Add(rs.getExpire(sess)).AddFlat(sh)
-	_, err = replaceScript.Do(conn, args...)
+
+	authKey := rs.authKey(authId)
+	return rs.doKey(ctx, authKey, func(conn redis.Conn) error {
+		_, err := redis.DoContext(conn, ctx, "SREM", authKey, sk)
+		return err
+	})
+}
+
+// Runs f with a connection to the server holding the key. The connection is
+// released when f returns, so it's not held while taking others from the pools.
+func (rs *RediStore) doKey(ctx context.Context, key string, f func(conn redis.Conn) error) error {
+	conn, err := rs.getConn(ctx, key)
 	if err != nil {
 		return err
 	}
+	defer conn.Close()
 
-	return nil
+	return f(conn)
+}
+
+// Gets a connection to the server holding the key.
+func (rs *RediStore) getConn(ctx context.Context, key string) (redis.Conn, error) {
+	if rs.cluster != nil {
+		return rs.cluster.GetContext(ctx, key)
+	}
+	return rs.Pool.GetContext(ctx)
+}
+
+// Returns the pools of all the servers.
+func (rs *RediStore) pools() []*redis.Pool {
+	if rs.cluster != nil {
+		return rs.cluster.Nodes()
+	}
+	return []*redis.Pool{rs.Pool}
+}
+
+// The keys of the session with the given ID. On Redis Cluster, they're tagged with
+// the session ID so they're on the same node.
+func (rs *RediStore) sessionKey(id string) string {
+	if rs.cluster != nil {
+		return rs.keyPrefix + "{" + id + "}"
+	}
+	return rs.keyPrefix + id
+}
+
+func (rs *RediStore) sessionID(sk string) string {
+	id := strings.TrimPrefix(sk, rs.keyPrefix)
+	if rs.cluster != nil {
+		id = strings.TrimSuffix(strings.TrimPrefix(id, "{"), "}")
+	}
+	return id
+}
+
+func (rs *RediStore) aliasKey(id string) string {
+	if rs.cluster != nil {
+		return rs.keyPrefix + ":alias:{" + id + "}"
+	}
+	return rs.keyPrefix + ":alias:" + id
 }
 
 func (rs *RediStore) authKey(authId string) string {
-	if authId != "" {
-		return rs.keyPrefix + ":auth:" + authId
+	if authId == "" {
+		return ""
 	}
-	return ""
+	if rs.cluster != nil {
+		return rs.authKeyPrefix() + "{" + authId + "}"
+	}
+	return rs.authKeyPrefix() + authId
+}
+
+func (rs *RediStore) authIDFromKey(authKey string) string {
+	authId := strings.TrimPrefix(authKey, rs.authKeyPrefix())
+	if rs.cluster != nil {
+		authId = strings.TrimSuffix(strings.TrimPrefix(authId, "{"), "}")
+	}
+	return authId
+}
+
+// Prefix of the keys of the sets holding the session keys of an auth ID.
+func (rs *RediStore) authKeyPrefix() string {
+	return rs.keyPrefix + ":auth:"
+}
+
+// Escapes the special characters of the glob-style patterns used by SCAN.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
 }
 
 func (rs *RediStore) ping() (bool, error) {
-	conn := rs.Pool.Get()
-	defer conn.Close()
-	data, err := conn.Do("PING")
-	if err != nil || data == nil {
-		return false, err
+	for _, pool := range rs.pools() {
+		conn := pool.Get()
+		data, err := conn.Do("PING")
+		conn.Close()
+		if err != nil || data == nil {
+			return false, err
+		}
+		if data != "PONG" {
+			return false, nil
+		}
 	}
-	return (data == "PONG"), nil
+	return true, nil
 }
 
 func (rs *RediStore) getExpire(sess *sersan.Session) int {
@@ -1,20 +1,19 @@
 package redis
 
 import (
-	"encoding/base32"
+	"context"
 	"fmt"
-	"math/rand"
 	"os"
 	"reflect"
-	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
-	"github.com/gorilla/securecookie"
 
 	"github.com/syaiful6/sersan"
+	"github.com/syaiful6/sersan/storagetest"
 )
 
 const (
@@ -22,40 +21,6 @@ const (
 	defaultRedisPort = "6379"
 )
 
-func generateSessionId() string {
-	return strings.TrimRight(
-		base32.StdEncoding.EncodeToString(
-			securecookie.GenerateRandomKey(32)), "=")
-}
-
-func generateSession(hasAuthID bool) *sersan.Session {
-	id := generateSessionId()
-	authId := ""
-	if hasAuthID {
-		authId = generateSessionId()
-	}
-
-	sess := sersan.NewSession(id, authId, time.Now().UTC())
-	sess.AccessedAt = sess.AccessedAt.Add(time.Duration(rand.Uint32()) * time.Second)
-
-	for i := 0; i < 20; i++ {
-		sess.Values[strconv.Itoa(rand.Int())] = strconv.Itoa(rand.Int())
-	}
-
-	return sess
-}
-
-func cloneSession(sess *sersan.Session, authID string) *sersan.Session {
-	nsess := sersan.NewSession(sess.ID, authID, sess.CreatedAt)
-	nsess.AccessedAt = sess.AccessedAt
-
-	for k, v := range sess.Values {
-		nsess.Values[k] = v
-	}
-
-	return nsess
-}
-
 func dial(network, address string) (redis.Conn, error) {
 	c, err := redis.Dial(network, address)
 	if err != nil {
@@ -93,7 +58,7 @@ func TestGetInsertDestroy(t *testing.T) {
 	if err != nil {
 		t.Fatalf("can't create redistore, returned %v", err)
 	}
-	sess := generateSession(false)
+	sess := storagetest.GenerateSession(false)
 
 	gsess, err := rs.Get(sess.ID)
 	if err != nil || gsess != nil {
@@ -109,7 +74,7 @@ func TestGetInsertDestroy(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Get returned error: %v", err)
 	}
-	assertSessionEqual(t, sess, gsess)
+	storagetest.AssertSessionEqual(t, sess, gsess)
 
 	err = rs.Destroy(sess.ID)
 	if err != nil {
@@ -131,27 +96,27 @@ func TestNonExistDestroyAllOfAuthId(t *testing.T) {
 	if err != nil {
 		t.Fatalf("can't create redistore, returned %v", err)
 	}
-	err = rs.DestroyAllOfAuthId(generateSessionId())
+	err = rs.DestroyAllOfAuthId(storagetest.GenerateSessionId())
 	if err != nil {
 		t.Fatalf("DestroyAllOfAuthId should not return error for non exists authId. %v", err)
 	}
 
 	// test if it only delete the relevant session
-	master := generateSession(true)
+	master := storagetest.GenerateSession(true)
 	authID := master.AuthID
 
 	preslaves := make([]*sersan.Session, 200)
 	for i := 0; i < 200; i++ {
-		preslaves[i] = generateSession(i > 100)
+		preslaves[i] = storagetest.GenerateSession(i > 100)
 	}
 	slaves := make([]*sersan.Session, 200)
 	for i := 0; i < 200; i++ {
-		slaves[i] = cloneSession(preslaves[i], authID)
+		slaves[i] = storagetest.CloneSession(preslaves[i], authID)
 	}
 
 	others := make([]*sersan.Session, 60)
 	for i := 0; i < 60; i++ {
-		others[i] = generateSession(i > 30)
+		others[i] = storagetest.GenerateSession(i > 30)
 	}
 
 	alls := append(slaves, master)
@@ -194,7 +159,7 @@ func TestNonExistDestroyAllOfAuthId(t *testing.T) {
 			t.Fatal("session should not nil if it exists")
 		}
 
-		assertSessionEqual(t, sess, nsess)
+		storagetest.AssertSessionEqual(t, sess, nsess)
 	}
 
 	err = rs.DestroyAllOfAuthId(authID)
@@ -233,8 +198,8 @@ func TestNonExistDestroyAllOfAuthId(t *testing.T) {
 }
 
 func TestInsertThrowIfSessionExist(t *testing.T) {
-	s1 := generateSession(true)
-	s2 := generateSession(true)
+	s1 := storagetest.GenerateSession(true)
+	s2 := storagetest.GenerateSession(true)
 	s2.ID = s1.ID
 
 	rs, err := NewRediStore(createRedisPool())
@@ -258,8 +223,98 @@ func TestInsertThrowIfSessionExist(t *testing.T) {
 	}
 }
 
+func TestConcurrentInsert(t *testing.T) {
+	rs, err := NewRediStore(createRedisPool())
+	if err != nil {
+		t.Fatalf("can't create redistore, returned %v", err)
+	}
+
+	const n = 20
+	id := storagetest.GenerateSessionId()
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sess := storagetest.GenerateSession(true)
+			sess.ID = id
+			errs <- rs.Insert(sess)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	inserted := 0
+	for err := range errs {
+		switch err.(type) {
+		case nil:
+			inserted++
+		case sersan.SessionAlreadyExists:
+		default:
+			t.Fatalf("Insert returned unexpected error: %v", err)
+		}
+	}
+	if inserted != 1 {
+		t.Fatalf("expected exactly one concurrent insert to succeed, %d did", inserted)
+	}
+}
+
+func TestConcurrentReplaceKeepsAuthIndex(t *testing.T) {
+	rs, err := NewRediStore(createRedisPool())
+	if err != nil {
+		t.Fatalf("can't create redistore, returned %v", err)
+	}
+
+	sess := storagetest.GenerateSession(false)
+	if err = rs.Insert(sess); err != nil {
+		t.Fatalf("Failed inserting session. return %v", err)
+	}
+	authIDs := []string{storagetest.GenerateSessionId(), storagetest.GenerateSessionId(), storagetest.GenerateSessionId()}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(authID string) {
+			defer wg.Done()
+			if err := rs.Replace(storagetest.CloneSession(sess, authID)); err != nil {
+				t.Errorf("Replace returned error: %v", err)
+			}
+		}(authIDs[i%len(authIDs)])
+	}
+	wg.Wait()
+
+	conn := rs.Pool.Get()
+	defer conn.Close()
+	assertAuthIndex := func(current string) {
+		for _, authID := range authIDs {
+			member, err := redis.Bool(conn.Do("SISMEMBER", rs.authKey(authID), rs.keyPrefix+sess.ID))
+			if err != nil {
+				t.Fatalf("SISMEMBER returned error: %v", err)
+			}
+			if member != (authID == current) {
+				t.Fatalf("session must only be in the auth set of %q, found in the set of %q: %v", current, authID, member)
+			}
+		}
+	}
+
+	gsess, err := rs.Get(sess.ID)
+	if err != nil || gsess == nil {
+		t.Fatalf("Get returned %v, %v", gsess, err)
+	}
+	assertAuthIndex(gsess.AuthID)
+
+	if err = rs.Destroy(sess.ID); err != nil {
+		t.Fatalf("Destroy returned error: %v", err)
+	}
+	assertAuthIndex("")
+	if err = rs.Destroy(sess.ID); err != nil {
+		t.Fatalf("Destroying non existing session returned error: %v", err)
+	}
+}
+
 func TestReplaceThrowIfSessionExist(t *testing.T) {
-	s1 := generateSession(true)
+	s1 := storagetest.GenerateSession(true)
 
 	rs, err := NewRediStore(createRedisPool())
 	if err != nil {
@@ -277,12 +332,444 @@ func TestReplaceThrowIfSessionExist(t *testing.T) {
 	}
 }
 
-func assertSessionEqual(t *testing.T, a *sersan.Session, b *sersan.Session) {
-	if !a.Equal(b) {
-		t.Fatalf("session saved and get not equal. ID: %s == %s. AuthID: %s == %s, CreatedAt: %s == %s, AccessedAt: %s == %s. Values DeepEqual %v",
-			a.ID, b.ID, a.AuthID, b.AuthID,
-			a.CreatedAt.Format(time.UnixDate), b.CreatedAt.Format(time.UnixDate),
-			a.AccessedAt.Format(time.UnixDate), b.AccessedAt.Format(time.UnixDate),
-			reflect.DeepEqual(a.Values, b.Values))
+func TestTouch(t *testing.T) {
+	rs, err := NewRediStore(createRedisPool())
+	if err != nil {
+		t.Fatalf("can't create redistore, returned %v", err)
+	}
+
+	sess := storagetest.GenerateSession(true)
+	if err = rs.Touch(sess.ID, time.Now().UTC(), 60); err != (sersan.SessionDoesNotExist{ID: sess.ID}) {
+		t.Fatalf("Touching non existing session must return SessionDoesNotExist. it return %v", err)
+	}
+	if gsess, _ := rs.Get(sess.ID); gsess != nil {
+		t.Fatal("Touch must not create non existing session")
+	}
+
+	if err = rs.Insert(sess); err != nil {
+		t.Fatalf("Failed inserting session. return %v", err)
+	}
+
+	accessedAt := sess.AccessedAt.Add(time.Hour)
+	if err = rs.Touch(sess.ID, accessedAt, 60); err != nil {
+		t.Fatalf("Touch returned error: %v", err)
+	}
+
+	gsess, err := rs.Get(sess.ID)
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	sess.AccessedAt = accessedAt
+	storagetest.AssertSessionEqual(t, sess, gsess)
+
+	conn := rs.Pool.Get()
+	defer conn.Close()
+	ttl, err := redis.Int(conn.Do("TTL", rs.keyPrefix+sess.ID))
+	if err != nil || ttl <= 0 || ttl > 60 {
+		t.Fatalf("expected session to expire in 60 seconds, TTL returned %d, %v", ttl, err)
+	}
+}
+
+func TestReplaceIfVersion(t *testing.T) {
+	rs, err := NewRediStore(createRedisPool())
+	if err != nil {
+		t.Fatalf("can't create redistore, returned %v", err)
+	}
+
+	sess := storagetest.GenerateSession(true)
+	if err = rs.ReplaceIfVersion(sess, 0); err != (sersan.SessionDoesNotExist{ID: sess.ID}) {
+		t.Fatalf("Replacing non existing session must return SessionDoesNotExist. it return %v", err)
+	}
+	if err = rs.Insert(sess); err != nil {
+		t.Fatalf("Failed inserting session. return %v", err)
+	}
+
+	s1 := *sess
+	s1.Values = map[interface{}]interface{}{"foo": "bar"}
+	s1.Version = 1
+	if err = rs.ReplaceIfVersion(&s1, 0); err != nil {
+		t.Fatalf("ReplaceIfVersion returned error: %v", err)
+	}
+
+	// loaded before s1 was saved
+	s2 := *sess
+	s2.Values = map[interface{}]interface{}{"foo": "baz"}
+	s2.Version = 1
+	if err = rs.ReplaceIfVersion(&s2, 0); err != (sersan.SessionVersionConflict{ID: sess.ID}) {
+		t.Fatalf("expected SessionVersionConflict, ReplaceIfVersion returned %v", err)
+	}
+
+	gsess, err := rs.Get(sess.ID)
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	if gsess.Version != 1 || gsess.Values["foo"] != "bar" {
+		t.Fatal("expected the session not to be replaced on conflict")
+	}
+}
+
+func TestApplyDelta(t *testing.T) {
+	rs, err := NewRediStore(createRedisPool())
+	if err != nil {
+		t.Fatalf("can't create redistore, returned %v", err)
+	}
+
+	sess := storagetest.GenerateSession(true)
+	delta := &sersan.SessionDelta{ID: sess.ID, AccessedAt: time.Now().UTC()}
+	if err = rs.ApplyDelta(delta, 60); err != (sersan.SessionDoesNotExist{ID: sess.ID}) {
+		t.Fatalf("Applying a delta to non existing session must return SessionDoesNotExist. it return %v", err)
+	}
+
+	sess.Values = map[interface{}]interface{}{"a": "a", "b": "b", "c": "c"}
+	if err = rs.Insert(sess); err != nil {
+		t.Fatalf("Failed inserting session. return %v", err)
+	}
+
+	// two concurrent requests modifying different keys
+	delta1 := &sersan.SessionDelta{ID: sess.ID, Updated: map[interface{}]interface{}{"a": "A", "d": 4}, AccessedAt: sess.AccessedAt}
+	delta2 := &sersan.SessionDelta{ID: sess.ID, Deleted: []interface{}{"b"}, AccessedAt: sess.AccessedAt}
+	if err = rs.ApplyDelta(delta1, 60); err != nil {
+		t.Fatalf("ApplyDelta returned error: %v", err)
+	}
+	if err = rs.ApplyDelta(delta2, 60); err != nil {
+		t.Fatalf("ApplyDelta returned error: %v", err)
+	}
+
+	gsess, err := rs.Get(sess.ID)
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	expected := map[interface{}]interface{}{"a": "A", "c": "c", "d": 4}
+	if !reflect.DeepEqual(gsess.Values, expected) {
+		t.Fatalf("expected values %v, got %v", expected, gsess.Values)
+	}
+	if gsess.Version != sess.Version+2 {
+		t.Fatalf("expected ApplyDelta to increment the version, got %d", gsess.Version)
+	}
+
+	// a full write drops the fields saved by ApplyDelta
+	gsess.Values = map[interface{}]interface{}{"e": "e"}
+	if err = rs.Replace(gsess); err != nil {
+		t.Fatalf("Replace returned error: %v", err)
+	}
+	if gsess, _ = rs.Get(sess.ID); !reflect.DeepEqual(gsess.Values, map[interface{}]interface{}{"e": "e"}) {
+		t.Fatalf("expected values to be replaced, got %v", gsess.Values)
+	}
+
+	// the value fields are folded into the session's data once they pile up
+	expected = map[interface{}]interface{}{"e": "e"}
+	for i := 0; i < 2*maxValueFields; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		delta := &sersan.SessionDelta{ID: sess.ID, Updated: map[interface{}]interface{}{key: i}, Deleted: []interface{}{"e"}}
+		if err = rs.ApplyDelta(delta, 60); err != nil {
+			t.Fatalf("ApplyDelta returned error: %v", err)
+		}
+		expected[key] = i
+	}
+	delete(expected, "e")
+	conn := rs.Pool.Get()
+	defer conn.Close()
+	fields, _ := redis.Strings(conn.Do("HKEYS", rs.sessionKey(sess.ID)))
+	valueFields := 0
+	for _, field := range fields {
+		if strings.HasPrefix(field, valueFieldPrefix) {
+			valueFields++
+		}
+	}
+	if valueFields >= maxValueFields {
+		t.Fatalf("expected the value fields to be folded, the session has %d", valueFields)
+	}
+	if gsess, _ = rs.Get(sess.ID); !reflect.DeepEqual(gsess.Values, expected) {
+		t.Fatalf("expected values %v, got %v", expected, gsess.Values)
+	}
+
+	bad := &sersan.SessionDelta{ID: sess.ID, Updated: map[interface{}]interface{}{1: "one"}}
+	if err = rs.ApplyDelta(bad, 60); err == nil {
+		t.Fatal("expected ApplyDelta to fail with a non-string key")
+	}
+}
+
+func TestAuthIndexExpire(t *testing.T) {
+	rs, err := NewRediStore(createRedisPool())
+	if err != nil {
+		t.Fatalf("can't create redistore, returned %v", err)
+	}
+	conn := rs.Pool.Get()
+	defer conn.Close()
+	authTTL := func(authId string) int {
+		ttl, err := redis.Int(conn.Do("TTL", rs.authKey(authId)))
+		if err != nil {
+			t.Fatalf("TTL returned error: %v", err)
+		}
+		return ttl
+	}
+
+	s1 := storagetest.GenerateSession(true)
+	s1.AccessedAt = time.Now().UTC()
+	if err = rs.Insert(s1); err != nil {
+		t.Fatalf("Failed inserting session. return %v", err)
+	}
+	sessionTTL, _ := redis.Int(conn.Do("TTL", rs.keyPrefix+s1.ID))
+	if ttl := authTTL(s1.AuthID); ttl < sessionTTL {
+		t.Fatalf("expected auth set to expire after its session, TTL %d < %d", ttl, sessionTTL)
+	}
+
+	// a session expiring later extends the set, one expiring earlier doesn't
+	if err = rs.Touch(s1.ID, s1.AccessedAt, sessionTTL+100); err != nil {
+		t.Fatalf("Touch returned error: %v", err)
+	}
+	if ttl := authTTL(s1.AuthID); ttl < sessionTTL+100 {
+		t.Fatalf("expected Touch to extend the auth set, TTL %d", ttl)
+	}
+	s2 := storagetest.CloneSession(storagetest.GenerateSession(false), s1.AuthID)
+	if err = rs.Insert(s2); err != nil {
+		t.Fatalf("Failed inserting session. return %v", err)
+	}
+	if err = rs.Touch(s2.ID, s2.AccessedAt, 60); err != nil {
+		t.Fatalf("Touch returned error: %v", err)
+	}
+	if ttl := authTTL(s1.AuthID); ttl < sessionTTL+100 {
+		t.Fatalf("expected auth set to live as long as its longest session, TTL %d", ttl)
+	}
+}
+
+func TestPruneAuthIndex(t *testing.T) {
+	rs, err := NewRediStore(createRedisPool())
+	if err != nil {
+		t.Fatalf("can't create redistore, returned %v", err)
+	}
+	conn := rs.Pool.Get()
+	defer conn.Close()
+
+	live := storagetest.GenerateSession(true)
+	expired := storagetest.CloneSession(storagetest.GenerateSession(false), live.AuthID)
+	moved := storagetest.CloneSession(storagetest.GenerateSession(false), live.AuthID)
+	for _, sess := range []*sersan.Session{live, expired, moved} {
+		if err = rs.Insert(sess); err != nil {
+			t.Fatalf("Failed inserting session. return %v", err)
+		}
+	}
+	if _, err = conn.Do("DEL", rs.keyPrefix+expired.ID); err != nil {
+		t.Fatalf("DEL returned error: %v", err)
+	}
+	// moved to another auth ID, behind the store's back
+	otherAuthID := storagetest.GenerateSessionId()
+	if _, err = conn.Do("HSET", rs.keyPrefix+moved.ID, "AuthID", otherAuthID); err != nil {
+		t.Fatalf("HSET returned error: %v", err)
+	}
+
+	// DestroyAllOfAuthId must not delete the moved session
+	destroyed := storagetest.CloneSession(live, live.AuthID)
+	destroyed.ID = storagetest.GenerateSessionId()
+	if err = rs.Insert(destroyed); err != nil {
+		t.Fatalf("Failed inserting session. return %v", err)
+	}
+	if err = rs.DestroyAllOfAuthId(live.AuthID); err != nil {
+		t.Fatalf("DestroyAllOfAuthId returned error: %v", err)
+	}
+	if gsess, _ := rs.Get(moved.ID); gsess == nil {
+		t.Fatal("DestroyAllOfAuthId must not delete sessions which belong to another auth ID")
+	}
+	if gsess, _ := rs.Get(destroyed.ID); gsess != nil {
+		t.Fatal("expected DestroyAllOfAuthId to delete the sessions of the auth ID")
+	}
+
+	for _, sess := range []*sersan.Session{live, expired} {
+		if err = rs.Insert(sess); err != nil {
+			t.Fatalf("Failed inserting session. return %v", err)
+		}
+	}
+	if _, err = conn.Do("DEL", rs.keyPrefix+expired.ID); err != nil {
+		t.Fatalf("DEL returned error: %v", err)
+	}
+	if _, err = conn.Do("SADD", rs.authKey(live.AuthID), rs.keyPrefix+moved.ID); err != nil {
+		t.Fatalf("SADD returned error: %v", err)
+	}
+
+	removed, err := rs.PruneAuthIndexes()
+	if err != nil {
+		t.Fatalf("PruneAuthIndexes returned error: %v", err)
+	}
+	if removed < 2 {
+		t.Fatalf("expected PruneAuthIndexes to remove at least 2 sessions, removed %d", removed)
+	}
+	members, err := redis.Strings(conn.Do("SMEMBERS", rs.authKey(live.AuthID)))
+	if err != nil || !reflect.DeepEqual(members, []string{rs.keyPrefix + live.ID}) {
+		t.Fatalf("expected only the live session to be kept, got %v, %v", members, err)
+	}
+
+	if removed, err = rs.PruneAuthIndex(live.AuthID); err != nil || removed != 0 {
+		t.Fatalf("expected nothing left to prune, removed %d, %v", removed, err)
+	}
+}
+
+func TestAlias(t *testing.T) {
+	rs, err := NewRediStore(createRedisPool())
+	if err != nil {
+		t.Fatalf("can't create redistore, returned %v", err)
+	}
+
+	sess := storagetest.GenerateSession(true)
+	if err = rs.Insert(sess); err != nil {
+		t.Fatalf("Failed inserting session. return %v", err)
+	}
+	if target, err := rs.ResolveAlias(sess.ID); err != nil || target != "" {
+		t.Fatalf("expected a session not to be an alias, got %q, %v", target, err)
+	}
+
+	if err = rs.Alias(sess.ID, "new-session-id", 60); err != nil {
+		t.Fatalf("Alias returned error: %v", err)
+	}
+	if gsess, _ := rs.Get(sess.ID); gsess != nil {
+		t.Fatal("expected aliased session to be destroyed")
+	}
+	if target, err := rs.ResolveAlias(sess.ID); err != nil || target != "new-session-id" {
+		t.Fatalf("expected alias to resolve to new-session-id, got %q, %v", target, err)
+	}
+
+	conn := rs.Pool.Get()
+	defer conn.Close()
+	if ok, _ := redis.Bool(conn.Do("SISMEMBER", rs.authKey(sess.AuthID), rs.keyPrefix+sess.ID)); ok {
+		t.Fatal("expected aliased session to be removed from its auth set")
+	}
+	ttl, err := redis.Int(conn.Do("TTL", rs.aliasKey(sess.ID)))
+	if err != nil || ttl <= 0 || ttl > 60 {
+		t.Fatalf("expected alias to expire in 60 seconds, TTL returned %d, %v", ttl, err)
+	}
+
+	// already an alias, e.g. rotated by a concurrent request
+	if _, ok := rs.Alias(sess.ID, "other-session-id", 60).(sersan.SessionDoesNotExist); !ok {
+		t.Fatal("expected Alias of a missing session to return SessionDoesNotExist")
+	}
+	if target, _ := rs.ResolveAlias(sess.ID); target != "new-session-id" {
+		t.Fatalf("expected alias not to be overwritten, resolves to %q", target)
+	}
+}
+
+func TestListByAuthId(t *testing.T) {
+	rs, err := NewRediStore(createRedisPool())
+	if err != nil {
+		t.Fatalf("can't create redistore, returned %v", err)
+	}
+
+	master := storagetest.GenerateSession(true)
+	sessions := map[string]*sersan.Session{master.ID: master}
+	for i := 0; i < 3; i++ {
+		sess := storagetest.GenerateSession(false)
+		sess.AuthID = master.AuthID
+		sessions[sess.ID] = sess
+	}
+	other := storagetest.GenerateSession(true)
+	for _, sess := range append([]*sersan.Session{other}, mapValues(sessions)...) {
+		if err = rs.Insert(sess); err != nil {
+			t.Fatalf("Insert returned error: %v", err)
+		}
+	}
+
+	listed, err := rs.ListByAuthId(master.AuthID)
+	if err != nil {
+		t.Fatalf("ListByAuthId returned error: %v", err)
 	}
+	if len(listed) != len(sessions) {
+		t.Fatalf("expected ListByAuthId to return %d sessions, returned %d", len(sessions), len(listed))
+	}
+	for _, sess := range listed {
+		expected, ok := sessions[sess.ID]
+		if !ok {
+			t.Fatalf("unexpected session %s returned by ListByAuthId", sess.ID)
+		}
+		storagetest.AssertSessionEqual(t, expected, sess)
+	}
+
+	// expired session, still in the auth set
+	expired := listed[0]
+	if expired.ID == master.ID {
+		expired = listed[1]
+	}
+	conn := rs.Pool.Get()
+	defer conn.Close()
+	if _, err = conn.Do("DEL", rs.keyPrefix+expired.ID); err != nil {
+		t.Fatalf("DEL returned error: %v", err)
+	}
+	if listed, err = rs.ListByAuthId(master.AuthID); err != nil || len(listed) != len(sessions)-1 {
+		t.Fatalf("expected ListByAuthId to skip expired session, returned %d sessions, %v", len(listed), err)
+	}
+
+	if err = rs.DestroyByAuthIdExcept(master.AuthID, master.ID); err != nil {
+		t.Fatalf("DestroyByAuthIdExcept returned error: %v", err)
+	}
+	if listed, err = rs.ListByAuthId(master.AuthID); err != nil || len(listed) != 1 || listed[0].ID != master.ID {
+		t.Fatal("expected DestroyByAuthIdExcept to keep only the given session")
+	}
+	for id := range sessions {
+		if gsess, _ := rs.Get(id); (gsess != nil) != (id == master.ID) {
+			t.Fatalf("session %s must only be kept if it's the given session", id)
+		}
+	}
+	if gsess, _ := rs.Get(other.ID); gsess == nil {
+		t.Fatal("DestroyByAuthIdExcept must not delete sessions of other auth ID")
+	}
+
+	if listed, err = rs.ListByAuthId(storagetest.GenerateSessionId()); err != nil || len(listed) != 0 {
+		t.Fatal("expected ListByAuthId of unknown auth ID to return empty list")
+	}
+}
+
+func mapValues(m map[string]*sersan.Session) []*sersan.Session {
+	sessions := make([]*sersan.Session, 0, len(m))
+	for _, sess := range m {
+		sessions = append(sessions, sess)
+	}
+	return sessions
+}
+
+func TestContextCanceled(t *testing.T) {
+	rs, err := NewRediStore(createRedisPool())
+	if err != nil {
+		t.Fatalf("can't create redistore, returned %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	sess := storagetest.GenerateSession(true)
+	if err = rs.InsertContext(ctx, sess); err == nil {
+		t.Fatal("expected InsertContext to fail with canceled context")
+	}
+
+	gsess, err := rs.GetContext(context.Background(), sess.ID)
+	if err != nil || gsess != nil {
+		t.Fatal("session must not be inserted with canceled context")
+	}
+}
+
+func TestPruneAuthIndexesSingleConnectionPool(t *testing.T) {
+	// the connection used by SCAN must be released before pruning the auth sets
+	pool := createRedisPool()
+	pool.MaxActive = 1
+	pool.Wait = true
+	rs, err := NewRediStore(pool)
+	if err != nil {
+		t.Fatalf("can't create redistore, returned %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sess := storagetest.GenerateSession(true)
+	if err = rs.InsertContext(ctx, sess); err != nil {
+		t.Fatalf("InsertContext returned error: %v", err)
+	}
+	if _, err = rs.PruneAuthIndexesContext(ctx); err != nil {
+		t.Fatalf("PruneAuthIndexesContext returned error: %v", err)
+	}
+}
+
+func TestStorageSuite(t *testing.T) {
+	storagetest.RunStorageSuite(t, func(t *testing.T) sersan.Storage {
+		rs, err := NewRediStore(createRedisPool())
+		if err != nil {
+			t.Fatalf("can't create redistore, returned %v", err)
+		}
+		return rs
+	})
 }
@@ -0,0 +1,134 @@
+package sersan
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+)
+
+// Unwrap returns the underlying http.ResponseWriter, used by http.ResponseController.
+func (w *sessionResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// ReadFrom implements io.ReaderFrom, so io.Copy to the response can still use the
+// underlying writer's fast path.
+func (w *sessionResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !w.hasWritten {
+		w.saveSession()
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	// hide our ReadFrom from io.Copy
+	return io.Copy(struct{ io.Writer }{w.ResponseWriter}, src)
+}
+
+func (w *sessionResponseWriter) flush() {
+	if !w.hasWritten {
+		w.saveSession()
+	}
+	if w.err != nil {
+		return
+	}
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+// The session is saved before the connection is taken over, but its cookie is
+// only sent if the caller writes the header in w.Header() itself.
+func (w *sessionResponseWriter) hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if !w.hasWritten {
+		w.saveSession()
+	}
+	if w.err != nil {
+		return nil, nil, w.err
+	}
+	return w.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+func (w *sessionResponseWriter) push(target string, opts *http.PushOptions) error {
+	return w.ResponseWriter.(http.Pusher).Push(target, opts)
+}
+
+type flusherFunc func()
+
+func (f flusherFunc) Flush() {
+	f()
+}
+
+type hijackerFunc func() (net.Conn, *bufio.ReadWriter, error)
+
+func (f hijackerFunc) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return f()
+}
+
+type pusherFunc func(target string, opts *http.PushOptions) error
+
+func (f pusherFunc) Push(target string, opts *http.PushOptions) error {
+	return f(target, opts)
+}
+
+// wrapResponseWriter returns w with the optional http.Flusher, http.Hijacker and
+// http.Pusher interfaces implemented if, and only if, the underlying writer
+// implements them. Handlers can then keep detecting those features with type
+// assertions.
+func wrapResponseWriter(w *sessionResponseWriter) http.ResponseWriter {
+	_, isFlusher := w.ResponseWriter.(http.Flusher)
+	_, isHijacker := w.ResponseWriter.(http.Hijacker)
+	_, isPusher := w.ResponseWriter.(http.Pusher)
+
+	var (
+		f = flusherFunc(w.flush)
+		h = hijackerFunc(w.hijack)
+		p = pusherFunc(w.push)
+	)
+
+	switch {
+	case isFlusher && isHijacker && isPusher:
+		return struct {
+			*sessionResponseWriter
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+		}{w, f, h, p}
+	case isFlusher && isHijacker:
+		return struct {
+			*sessionResponseWriter
+			http.Flusher
+			http.Hijacker
+		}{w, f, h}
+	case isFlusher && isPusher:
+		return struct {
+			*sessionResponseWriter
+			http.Flusher
+			http.Pusher
+		}{w, f, p}
+	case isHijacker && isPusher:
+		return struct {
+			*sessionResponseWriter
+			http.Hijacker
+			http.Pusher
+		}{w, h, p}
+	case isFlusher:
+		return struct {
+			*sessionResponseWriter
+			http.Flusher
+		}{w, f}
+	case isHijacker:
+		return struct {
+			*sessionResponseWriter
+			http.Hijacker
+		}{w, h}
+	case isPusher:
+		return struct {
+			*sessionResponseWriter
+			http.Pusher
+		}{w, p}
+	}
+
+	return w
+}
@@ -0,0 +1,160 @@
+package sersan
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (w *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return nil, nil, nil
+}
+
+type pushRecorder struct {
+	*httptest.ResponseRecorder
+	pushed []string
+}
+
+func (w *pushRecorder) Push(target string, opts *http.PushOptions) error {
+	w.pushed = append(w.pushed, target)
+	return nil
+}
+
+func newStreamingSessionState() (*ServerSessionState, *StorageRecorder) {
+	storage := NewStorageRecorder()
+	ss := NewServerSessionState(storage, []byte("secret-key"))
+	ss.SetCookieName("session-name")
+	return ss, storage
+}
+
+func TestFlushSavesSession(t *testing.T) {
+	ss, storage := newStreamingSessionState()
+	handler := SessionMiddleware(ss)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess, _ := GetSession(r)
+		sess["foo"] = "bar"
+
+		f, ok := w.(http.Flusher)
+		if !ok {
+			t.Fatal("expected response writer to implement http.Flusher")
+		}
+		if _, ok = w.(http.Hijacker); ok {
+			t.Fatal("response writer must not implement http.Hijacker")
+		}
+		f.Flush()
+		if op := storage.GetOperations(); len(op) != 1 || op[0].Tag != "Insert" {
+			t.Fatal("expected session to be saved before flushing")
+		}
+		w.Write([]byte("data"))
+		f.Flush()
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8080/", nil))
+
+	if !w.Flushed {
+		t.Fatal("expected underlying response writer to be flushed")
+	}
+	if cookies := w.Result().Cookies(); len(cookies) != 1 {
+		t.Fatalf("expected session cookie to be sent with the flushed header, got %v", cookies)
+	}
+	if w.Body.String() != "data" {
+		t.Fatalf("unexpected body %q", w.Body.String())
+	}
+	if op := storage.GetOperations(); len(op) != 0 {
+		t.Fatal("expected session to be saved only once")
+	}
+}
+
+func TestHijackSavesSession(t *testing.T) {
+	ss, storage := newStreamingSessionState()
+	handler := SessionMiddleware(ss)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess, _ := GetSession(r)
+		sess["foo"] = "bar"
+
+		h, ok := w.(http.Hijacker)
+		if !ok {
+			t.Fatal("expected response writer to implement http.Hijacker")
+		}
+		if _, ok = w.(http.Pusher); ok {
+			t.Fatal("response writer must not implement http.Pusher")
+		}
+		if _, _, err := h.Hijack(); err != nil {
+			t.Fatalf("Hijack returned error: %v", err)
+		}
+	}))
+
+	w := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8080/", nil))
+
+	if !w.hijacked {
+		t.Fatal("expected underlying response writer to be hijacked")
+	}
+	if op := storage.GetOperations(); len(op) != 1 || op[0].Tag != "Insert" {
+		t.Fatal("expected session to be saved once before hijacking")
+	}
+	if w.Header().Get("Set-Cookie") == "" {
+		t.Fatal("expected session cookie to be set in the header before hijacking")
+	}
+}
+
+func TestPushAndUnwrap(t *testing.T) {
+	ss, _ := newStreamingSessionState()
+	rec := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	handler := SessionMiddleware(ss)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := w.(http.Pusher)
+		if !ok {
+			t.Fatal("expected response writer to implement http.Pusher")
+		}
+		if err := p.Push("/style.css", nil); err != nil {
+			t.Fatalf("Push returned error: %v", err)
+		}
+
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok || u.Unwrap() != rec {
+			t.Fatal("expected Unwrap to return the underlying response writer")
+		}
+	}))
+
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "http://localhost:8080/", nil))
+	if len(rec.pushed) != 1 || rec.pushed[0] != "/style.css" {
+		t.Fatalf("expected push to be delegated, got %v", rec.pushed)
+	}
+}
+
+func TestReadFromSavesSession(t *testing.T) {
+	ss, storage := newStreamingSessionState()
+	handler := SessionMiddleware(ss)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess, _ := GetSession(r)
+		sess["foo"] = "bar"
+
+		if _, ok := w.(io.ReaderFrom); !ok {
+			t.Fatal("expected response writer to implement io.ReaderFrom")
+		}
+		if _, err := io.Copy(w, strings.NewReader("copied")); err != nil {
+			t.Fatalf("io.Copy returned error: %v", err)
+		}
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:8080/", nil))
+
+	if w.Body.String() != "copied" {
+		t.Fatalf("unexpected body %q", w.Body.String())
+	}
+	if cookies := w.Result().Cookies(); len(cookies) != 1 {
+		t.Fatalf("expected session cookie to be set, got %v", cookies)
+	}
+	if op := storage.GetOperations(); len(op) != 1 || op[0].Tag != "Insert" {
+		t.Fatal("expected session to be saved once")
+	}
+}
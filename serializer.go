@@ -0,0 +1,65 @@
+package sersan
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+// SessionSerializer encodes and decodes Session.Values, storage backends use it to
+// save the user-data as a single blob.
+type SessionSerializer interface {
+	Serialize(s *Session) ([]byte, error)
+	Deserialize(b []byte, s *Session) error
+}
+
+// JSONSerializer encode the session values as JSON object. The keys of the session
+// values must be string.
+type JSONSerializer struct{}
+
+func (js JSONSerializer) Serialize(s *Session) ([]byte, error) {
+	m := make(map[string]interface{}, len(s.Values))
+	for k, v := range s.Values {
+		ks, ok := k.(string)
+		if !ok {
+			err := fmt.Errorf("Non-string key value, cannot serialize session to JSON: %v", k)
+			return nil, err
+		}
+		m[ks] = v
+	}
+	return json.Marshal(m)
+}
+
+func (js JSONSerializer) Deserialize(b []byte, ss *Session) error {
+	m := make(map[string]interface{})
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	if ss.Values == nil {
+		ss.Values = make(map[interface{}]interface{})
+	}
+	for k, v := range m {
+		ss.Values[k] = v
+	}
+	return nil
+}
+
+// GobSerializer encode the session values using encoding/gob. Types other than
+// the basic ones need to be registered with gob.Register.
+type GobSerializer struct{}
+
+func (g GobSerializer) Serialize(ss *Session) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	enc := gob.NewEncoder(buf)
+	err := enc.Encode(ss.Values)
+	if err == nil {
+		return buf.Bytes(), nil
+	}
+	return nil, err
+}
+
+func (g GobSerializer) Deserialize(b []byte, ss *Session) error {
+	dec := gob.NewDecoder(bytes.NewBuffer(b))
+	return dec.Decode(&ss.Values)
+}
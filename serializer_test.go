@@ -1,4 +1,4 @@
-package redis
+package sersan
 
 import (
 	"encoding/gob"
@@ -6,20 +6,18 @@ import (
 	"reflect"
 	"testing"
 	"time"
-
-	"github.com/syaiful6/sersan"
 )
 
 func TestJSONSerializer(t *testing.T) {
 	serializer := JSONSerializer{}
-	sess := sersan.NewSession("foo", "john", time.Now().UTC())
+	sess := NewSession("foo", "john", time.Now().UTC())
 	sess.Values["bar"] = "baz"
 	bytes, err := serializer.Serialize(sess)
 	if err != nil {
 		t.Fatalf("JSONSerializer.Serialize expected non nil error, it return error: %v", err)
 	}
 
-	sess2 := new(sersan.Session)
+	sess2 := new(Session)
 	err = serializer.Deserialize(bytes, sess2)
 	if err != nil {
 		t.Fatalf("JSONSerializer.Deserialize expected non nil error, it return error: %v", err)
@@ -34,14 +32,14 @@ type testKey struct{}
 
 func TestGobSerializer(t *testing.T) {
 	serializer := GobSerializer{}
-	sess := sersan.NewSession("foo", "john", time.Now().UTC())
+	sess := NewSession("foo", "john", time.Now().UTC())
 	sess.Values[testKey{}] = "baz"
 	bytes, err := serializer.Serialize(sess)
 	if err != nil {
 		t.Fatalf("GobSerializer.Serialize expected non nil error, it return error: %v", err)
 	}
 
-	sess2 := new(sersan.Session)
+	sess2 := new(Session)
 	err = serializer.Deserialize(bytes, sess2)
 	if err != nil {
 		t.Fatalf("GobSerializer.Deserialize expected non nil error, it return error: %v", err)
@@ -1,8 +1,11 @@
 package sersan
 
 import (
+	"context"
 	"encoding/base32"
 	"fmt"
+	"log"
+	"net/http"
 	"reflect"
 	"strings"
 	"time"
@@ -19,8 +22,38 @@ const (
 	DontForceInvalidate
 )
 
+func (f ForceInvalidate) isValid() bool {
+	return f == CurrentSessionID || f == AllSessionIDsOfLoggedUser || f == DontForceInvalidate
+}
+
+// ConflictStrategy tells how ServerSessionState handles a session replaced by a
+// concurrent request since it was loaded. It's only used with storages
+// implementing VersionReplacer.
+type ConflictStrategy int
+
+const (
+	// The last request saving the session overwrites the changes of the others.
+	LastWriteWins ConflictStrategy = iota
+	// Saving the session fails with SessionVersionConflict.
+	FailOnConflict
+	// The keys modified during the request are applied to the stored session, and
+	// saving it is retried. Fails with SessionVersionConflict if the auth ID of the
+	// stored session changed, or it keeps conflicting.
+	MergeOnConflict
+)
+
+// how many times MergeOnConflict retries saving the session
+const maxMergeRetries = 3
+
 const (
 	ForceInvalidateKey = "_forceinvalidate"
+	// Session key holding the flash messages, see AddFlash.
+	FlashKey = "_flash"
+	// Session key holding when the session ID was last rotated, in unix time. It's
+	// only saved when ServerSessionState.RotationInterval is set.
+	RotatedAtKey = "_rotatedat"
+	// Session key marking a rotated session, holding the new session ID.
+	RotatedToKey = "_rotatedto"
 )
 
 // Representation of a saved session
@@ -35,6 +68,27 @@ type Session struct {
 	CreatedAt time.Time
 	// When this session was last accessed in UTC
 	AccessedAt time.Time
+	// Information about the client of this session, separate from Values
+	Metadata Metadata
+	// Binding of the session to the client which created it, see Binder
+	Binding string
+	// Version of the session, incremented every time it's replaced, see
+	// VersionReplacer
+	Version int64
+}
+
+// Metadata about the client using a session, captured by SessionMiddleware when
+// ServerSessionState.CaptureMetadata is enabled. It's meant for security auditing
+// and for listing the devices a user is logged in.
+type Metadata struct {
+	// IP address of the client when the session was created
+	IP string
+	// IP address of the client when the session was last saved
+	LastSeenIP string
+	// User-Agent header of the client when the session was created
+	UserAgent string
+	// Label of the session, e.g. a device name chosen by the user, see SetLabel
+	Label string
 }
 
 func NewSession(id, authId string, now time.Time) *Session {
@@ -109,25 +163,31 @@ type DecomposedSession struct {
 	Decomposed map[interface{}]interface{}
 }
 
-func decomposeSession(authKey string, sess map[interface{}]interface{}) *DecomposedSession {
+func decomposeSession(authKey string, sess map[interface{}]interface{}) (*DecomposedSession, error) {
 	var (
 		authId = ""
 		force  = DontForceInvalidate
+		ok     bool
 	)
-	if v, ok := sess[authKey]; ok {
-		delete(sess, authKey)
-		authId = v.(string)
+	if v, exists := sess[authKey]; exists {
+		if authId, ok = v.(string); !ok {
+			return nil, fmt.Errorf("sersan: auth ID under the session key %s must be a string, got %T", authKey, v)
+		}
 	}
-	if v, ok := sess[ForceInvalidateKey]; ok {
-		delete(sess, ForceInvalidateKey)
-		force = v.(ForceInvalidate)
+	if v, exists := sess[ForceInvalidateKey]; exists {
+		if force, ok = v.(ForceInvalidate); !ok || !force.isValid() {
+			return nil, fmt.Errorf("sersan: invalid ForceInvalidate value under the session key %s: %v", ForceInvalidateKey, v)
+		}
 	}
+	// only modify the session once it's known to be valid
+	delete(sess, authKey)
+	delete(sess, ForceInvalidateKey)
 
 	return &DecomposedSession{
 		AuthID:     authId,
 		Force:      force,
 		Decomposed: sess,
-	}
+	}, nil
 }
 
 func recomposeSession(authKey, authId string, sess map[interface{}]interface{}) map[interface{}]interface{} {
@@ -144,24 +204,134 @@ type ServerSessionState struct {
 	cookieName                   string
 	AuthKey                      string
 	storage                      Storage
+	ctxStorage                   StorageContext
 	Options                      *Options
 	Codecs                       []securecookie.Codec
 	IdleTimeout, AbsoluteTimeout int
+	// Sessions whose data is not modified during the request are only written back
+	// to the storage, to update their AccessedAt, when at least TouchInterval has
+	// passed since they were last accessed. Zero writes them on every request.
+	// Storages implementing Toucher only get their AccessedAt updated.
+	//
+	// Modifications are detected by comparing the session data with a shallow copy
+	// taken when it was loaded, so store a new value instead of mutating a map or
+	// struct pointer already saved in the session.
+	TouchInterval time.Duration
+	// ConflictStrategy tells what to do when the session was replaced by a concurrent
+	// request since it was loaded. Defaults to LastWriteWins. It requires a storage
+	// implementing VersionReplacer, otherwise the last write always wins.
+	ConflictStrategy ConflictStrategy
+	// If DeltaSave is true, only the values added, updated or deleted during the
+	// request are written to the storage, so concurrent requests modifying different
+	// keys don't overwrite each other's changes. ConflictStrategy isn't used then.
+	// It requires a storage implementing DeltaStorage, and is ignored otherwise.
+	// The keys of the session values must be strings, Save fails otherwise.
+	//
+	// The session returned by Save only has the values of the request, not the ones
+	// written concurrently.
+	DeltaSave bool
+	// ErrorHandler is called by SessionMiddleware when the session can't be loaded
+	// or saved. Defaults to DefaultErrorHandler.
+	ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+	// If DegradeOnError is true, SessionMiddleware doesn't fail the request when the
+	// storage is unavailable. When loading fails, the request is served with an empty
+	// session that is never saved, and when saving fails the response is sent without
+	// the session cookie. The errors are only logged to ErrorLog.
+	DegradeOnError bool
+	// If CaptureMetadata is true, SessionMiddleware saves the client's IP address and
+	// user agent in the session's Metadata.
+	CaptureMetadata bool
+	// IPExtractor returns the IP address of the client, used when CaptureMetadata is
+	// enabled. Defaults to RemoteAddrIP, use ForwardedForIP behind reverse proxies.
+	IPExtractor IPExtractor
+	// If RotationInterval is not zero, the ID of active sessions is rotated when it's
+	// older than RotationInterval. Unlike the rotation on login, the session keeps
+	// its CreatedAt, so the absolute timeout still applies.
+	RotationInterval time.Duration
+	// The old session ID of a rotated session stays valid for RotationGracePeriod,
+	// loading the new session, so concurrent requests sent with the old cookie
+	// don't lose the session. Zero destroys the old session immediately. Storages
+	// implementing Aliaser keep an alias of the new session, the other ones have
+	// the old session replaced by a session holding the new session ID, expired
+	// by storages implementing Toucher. A session is only rotated once, concurrent
+	// requests rotating it too save their data to the session it was rotated to.
+	RotationGracePeriod time.Duration
+	// When the session ID is invalidated because the auth ID changed, e.g. on login,
+	// the old session ID stays valid for InvalidationGracePeriod, loading the new
+	// session, so parallel requests sent with the old cookie aren't logged out. It
+	// requires a storage implementing Aliaser, and is never applied when all the
+	// sessions of the user are invalidated.
+	//
+	// Beware that it reopens the door to session fixation during the grace period:
+	// an attacker who planted the old session ID can use it to get the new session.
+	// Keep it as short as possible, a few seconds, or use a Binder.
+	InvalidationGracePeriod time.Duration
+	// Binder binds the sessions to the client which created them, sessions used by
+	// another client are treated as missing. Disabled if nil, the binding is only
+	// verified by LoadRequest and SessionMiddleware.
+	Binder Binder
+	// OnBindingMismatch is called when a session is used by a client not matching
+	// its binding, e.g. to log a possible hijacking. The session is used anyway if
+	// it returns true.
+	OnBindingMismatch func(r *http.Request, sess *Session) bool
+	// ErrorLog specifies an optional logger for errors that aren't reported to
+	// ErrorHandler. If nil, logging is done via the log package's standard logger.
+	ErrorLog *log.Logger
+}
+
+// DefaultErrorHandler replies to the request with an HTTP 500 internal server error.
+// The error itself is not sent to the client.
+func DefaultErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 }
 
 type SaveSessionToken struct {
 	sess *Session
 	now  time.Time
+	// copy of the session values when it was loaded
+	snapshot map[interface{}]interface{}
+	// metadata to save with the session
+	metadata Metadata
+	// binding to save with the session
+	binding string
+	// when the session ID was last rotated
+	rotatedAt time.Time
+}
+
+// Returns true if the session data differs from the one loaded, or we can't tell.
+func (token *SaveSessionToken) isModified(dec *DecomposedSession) bool {
+	return token.snapshot == nil || !reflect.DeepEqual(token.snapshot, dec.Decomposed) ||
+		(token.sess != nil && (token.sess.Metadata != token.metadata || token.sess.Binding != token.binding))
+}
+
+// Record the client of the current request in the metadata.
+func (token *SaveSessionToken) setClient(ip, userAgent string) {
+	if token.sess == nil || token.metadata.IP == "" {
+		token.metadata.IP = ip
+		token.metadata.UserAgent = truncateUserAgent(userAgent)
+	}
+	token.metadata.LastSeenIP = ip
+}
+
+func truncateUserAgent(ua string) string {
+	if len(ua) <= maxUserAgentLength {
+		return ua
+	}
+	return strings.ToValidUTF8(ua[:maxUserAgentLength], "")
 }
 
 func NewServerSessionState(storage Storage, keyPairs ...[]byte) *ServerSessionState {
 	return &ServerSessionState{
 		cookieName:      "sersan:session",
 		storage:         storage,
+		ctxStorage:      WithContext(storage),
 		Codecs:          securecookie.CodecsFromPairs(keyPairs...),
 		IdleTimeout:     604800,  // 7 days
 		AbsoluteTimeout: 5184000, // 60 days
 		AuthKey:         "_authID",
+		TouchInterval:   time.Minute,
+		ErrorHandler:    DefaultErrorHandler,
+		IPExtractor:     RemoteAddrIP,
 		Options: &Options{
 			Path:     "/",
 			HttpOnly: true,
@@ -169,6 +339,104 @@ func NewServerSessionState(storage Storage, keyPairs ...[]byte) *ServerSessionSt
 	}
 }
 
+// ListSessions returns the sessions of the given auth ID which are not expired yet,
+// for example to show the devices a user is logged in. It returns ErrNotSupported
+// if the storage doesn't implement AuthIndex.
+func (ss *ServerSessionState) ListSessions(authId string) ([]*Session, error) {
+	return ss.ListSessionsContext(context.Background(), authId)
+}
+
+// ListSessionsContext is like ListSessions, but the storage backend is called with
+// the given context.
+func (ss *ServerSessionState) ListSessionsContext(ctx context.Context, authId string) ([]*Session, error) {
+	index, ok := ss.storage.(AuthIndex)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	if authId == "" {
+		return []*Session{}, nil
+	}
+
+	sessions, err := listByAuthIdContext(ctx, index, authId)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	active := make([]*Session, 0, len(sessions))
+	for _, sess := range sessions {
+		if !sess.IsSessionExpired(ss.IdleTimeout, ss.AbsoluteTimeout, now) && !isRotated(sess) {
+			active = append(active, sess)
+		}
+	}
+
+	return active, nil
+}
+
+// RevokeSession destroys the session with the given session ID, if it belongs to
+// the given auth ID. Returns 'SessionDoesNotExist' otherwise.
+func (ss *ServerSessionState) RevokeSession(authId, id string) error {
+	return ss.RevokeSessionContext(context.Background(), authId, id)
+}
+
+// RevokeSessionContext is like RevokeSession, but the storage backend is called with
+// the given context.
+func (ss *ServerSessionState) RevokeSessionContext(ctx context.Context, authId, id string) error {
+	sess, err := ss.ctxStorage.GetContext(ctx, id)
+	if err != nil {
+		return err
+	}
+	if sess == nil || authId == "" || sess.AuthID != authId {
+		return SessionDoesNotExist{ID: id}
+	}
+
+	return ss.ctxStorage.DestroyContext(ctx, id)
+}
+
+// DestroyOtherSessions destroys the sessions of the given auth ID except the one
+// with the session ID keepId, usually the current one. It returns ErrNotSupported
+// if the storage doesn't implement AuthIndex.
+func (ss *ServerSessionState) DestroyOtherSessions(authId, keepId string) error {
+	return ss.DestroyOtherSessionsContext(context.Background(), authId, keepId)
+}
+
+// DestroyOtherSessionsContext is like DestroyOtherSessions, but the storage backend
+// is called with the given context.
+func (ss *ServerSessionState) DestroyOtherSessionsContext(ctx context.Context, authId, keepId string) error {
+	index, ok := ss.storage.(AuthIndex)
+	if !ok {
+		return ErrNotSupported
+	}
+	if authId == "" {
+		return nil
+	}
+
+	return destroyByAuthIdExceptContext(ctx, index, authId, keepId)
+}
+
+func (ss *ServerSessionState) clientIP(r *http.Request) string {
+	if ss.IPExtractor != nil {
+		return ss.IPExtractor(r)
+	}
+	return RemoteAddrIP(r)
+}
+
+func (ss *ServerSessionState) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	if ss.ErrorHandler != nil {
+		ss.ErrorHandler(w, r, err)
+		return
+	}
+	DefaultErrorHandler(w, r, err)
+}
+
+func (ss *ServerSessionState) logf(format string, args ...interface{}) {
+	if ss.ErrorLog != nil {
+		ss.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
 func (ss *ServerSessionState) SetCookieName(name string) error {
 	if !isCookieNameValid(name) {
 		return fmt.Errorf("sersan: invalid character in cookie name: %s", name)
@@ -179,34 +447,201 @@ func (ss *ServerSessionState) SetCookieName(name string) error {
 
 // Load the session map from the storage backend.
 func (ss *ServerSessionState) Load(cookieValue string) (map[interface{}]interface{}, *SaveSessionToken, error) {
+	return ss.LoadContext(context.Background(), cookieValue)
+}
+
+// LoadContext is like Load, but the storage backend is called with the given context.
+func (ss *ServerSessionState) LoadContext(ctx context.Context, cookieValue string) (map[interface{}]interface{}, *SaveSessionToken, error) {
+	return ss.load(ctx, nil, cookieValue)
+}
+
+// LoadRequest is like LoadContext with the request's context, and also applies the
+// policies needing the request: the session's Binding is verified, and the client
+// is recorded in its Metadata if CaptureMetadata is enabled. SessionMiddleware
+// uses it.
+func (ss *ServerSessionState) LoadRequest(r *http.Request, cookieValue string) (map[interface{}]interface{}, *SaveSessionToken, error) {
+	return ss.load(r.Context(), r, cookieValue)
+}
+
+func (ss *ServerSessionState) load(ctx context.Context, r *http.Request, cookieValue string) (map[interface{}]interface{}, *SaveSessionToken, error) {
 	var (
-		err error
-		now = time.Now().UTC()
+		err   error
+		sess  *Session
+		now   = time.Now().UTC()
+		data  map[interface{}]interface{}
+		token *SaveSessionToken
 	)
 
 	if cookieValue != "" {
-		sess, err := ss.storage.Get(cookieValue)
-		if err == nil && sess != nil {
-			if !sess.IsSessionExpired(ss.IdleTimeout, ss.AbsoluteTimeout, now) {
-				return recomposeSession(ss.AuthKey, sess.AuthID, sess.Values), &SaveSessionToken{now: now, sess: sess}, err
+		sess, err = ss.ctxStorage.GetContext(ctx, cookieValue)
+		if err != nil {
+			return nil, nil, err
+		}
+		if sess == nil {
+			sess, err = ss.loadAlias(ctx, cookieValue)
+			if err != nil {
+				return nil, nil, err
 			}
 		}
+		if sess != nil && isRotated(sess) {
+			sess, err = ss.loadRotated(ctx, sess, now)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		if sess != nil && (sess.IsSessionExpired(ss.IdleTimeout, ss.AbsoluteTimeout, now) || !ss.verifyBinding(r, sess)) {
+			sess = nil
+		}
 	}
 
-	data := make(map[interface{}]interface{})
+	if sess != nil {
+		token = &SaveSessionToken{
+			now:       now,
+			sess:      sess,
+			metadata:  sess.Metadata,
+			binding:   sess.Binding,
+			rotatedAt: rotatedAt(sess),
+		}
+		if _, ok := sess.Values[RotatedAtKey]; ok {
+			// don't modify the storage's copy
+			sess.Values = copyValues(sess.Values)
+			delete(sess.Values, RotatedAtKey)
+		}
+		token.snapshot = copyValues(sess.Values)
+		data = recomposeSession(ss.AuthKey, sess.AuthID, sess.Values)
+	} else {
+		token = &SaveSessionToken{now: now, sess: nil}
+		data = make(map[interface{}]interface{})
+	}
 
-	return data, &SaveSessionToken{now: now, sess: nil}, err
+	if r != nil {
+		if ss.CaptureMetadata {
+			token.setClient(ss.clientIP(r), r.UserAgent())
+		}
+		// new sessions, or sessions saved before the binder was configured
+		if ss.Binder != nil && token.binding == "" {
+			token.binding = ss.Binder.Bind(r)
+		}
+	}
+
+	return data, token, nil
 }
 
-//
+// Loads the session the given session ID is an alias of, if any.
+func (ss *ServerSessionState) loadAlias(ctx context.Context, id string) (*Session, error) {
+	if ss.RotationGracePeriod <= 0 && ss.InvalidationGracePeriod <= 0 {
+		return nil, nil
+	}
+	aliaser, ok := ss.storage.(Aliaser)
+	if !ok {
+		return nil, nil
+	}
+
+	target, err := resolveAliasContext(ctx, aliaser, id)
+	if err != nil || target == "" {
+		return nil, err
+	}
+
+	return ss.ctxStorage.GetContext(ctx, target)
+}
+
+// Loads the session a rotated session was rotated to, if the grace period isn't
+// over yet. Otherwise the rotated session is destroyed.
+func (ss *ServerSessionState) loadRotated(ctx context.Context, sess *Session, now time.Time) (*Session, error) {
+	if now.Sub(sess.AccessedAt) >= ss.RotationGracePeriod {
+		return nil, ss.ctxStorage.DestroyContext(ctx, sess.ID)
+	}
+
+	nsess, err := ss.ctxStorage.GetContext(ctx, sess.Values[RotatedToKey].(string))
+	// only follow a single rotation
+	if err != nil || nsess == nil || isRotated(nsess) {
+		return nil, err
+	}
+
+	return nsess, nil
+}
+
+func isRotated(sess *Session) bool {
+	_, ok := sess.Values[RotatedToKey].(string)
+	return ok
+}
+
+// Returns when the session ID was last rotated, its creation time if it never was.
+func rotatedAt(sess *Session) time.Time {
+	if ts, ok := convertValue[int64](sess.Values[RotatedAtKey]); ok {
+		return time.Unix(ts, 0).UTC()
+	}
+	return sess.CreatedAt
+}
+
+// Returns false if the session's binding doesn't match the request's client, and
+// OnBindingMismatch doesn't accept it anyway.
+func (ss *ServerSessionState) verifyBinding(r *http.Request, sess *Session) bool {
+	if r == nil || ss.Binder == nil || sess.Binding == "" || ss.Binder.Verify(r, sess.Binding) {
+		return true
+	}
+	if ss.OnBindingMismatch != nil {
+		return ss.OnBindingMismatch(r, sess)
+	}
+	return false
+}
+
+// Save the session data to the storage backend, returns the saved session or nil
+// if there was nothing to save.
 func (ss *ServerSessionState) Save(token *SaveSessionToken, data map[interface{}]interface{}) (*Session, error) {
-	outputDecomp := decomposeSession(ss.AuthKey, data)
-	sess, err := ss.invalidateIfNeeded(token.sess, outputDecomp)
+	return ss.SaveContext(context.Background(), token, data)
+}
+
+// SaveContext is like Save, but the storage backend is called with the given context.
+func (ss *ServerSessionState) SaveContext(ctx context.Context, token *SaveSessionToken, data map[interface{}]interface{}) (*Session, error) {
+	outputDecomp, err := decomposeSession(ss.AuthKey, data)
+	if err != nil {
+		return nil, err
+	}
+	if err = ss.checkDeltaKeys(outputDecomp); err != nil {
+		return nil, err
+	}
+
+	// never keep the old session ID usable when all sessions must go
+	var aliaser Aliaser
+	if token.sess != nil && outputDecomp.Force != AllSessionIDsOfLoggedUser {
+		aliaser = ss.aliaser(ss.InvalidationGracePeriod)
+	}
+
+	sess, err := ss.invalidateIfNeeded(ctx, token.sess, outputDecomp, aliaser == nil)
 	if err != nil {
 		return nil, err
 	}
 
-	return ss.saveSessionOnDb(token.now, sess, outputDecomp)
+	// invalidated, the old session ID becomes an alias of the new session
+	if token.sess != nil && sess == nil && aliaser != nil {
+		nsess, err := ss.saveSessionOnDb(ctx, token, nil, outputDecomp)
+		if err != nil {
+			return nil, err
+		}
+		err = ss.aliasSession(ctx, aliaser, token.sess.ID, nsess, ss.InvalidationGracePeriod)
+		// already invalidated by a concurrent request, there's nothing to alias
+		if _, ok := err.(SessionDoesNotExist); err != nil && !ok {
+			return nil, err
+		}
+		return nsess, nil
+	}
+
+	if sess != nil && ss.RotationInterval > 0 && token.now.Sub(token.rotatedAt) >= ss.RotationInterval {
+		return ss.rotateSession(ctx, token, sess, outputDecomp)
+	}
+
+	// the session wasn't invalidated nor modified, no need to rewrite it.
+	if sess != nil && !token.isModified(outputDecomp) {
+		if token.now.Sub(sess.AccessedAt) < ss.TouchInterval {
+			return sess, nil
+		}
+		if toucher, ok := ss.storage.(Toucher); ok {
+			return ss.touchSession(ctx, toucher, token.now, sess)
+		}
+	}
+
+	return ss.saveSessionOnDb(ctx, token, sess, outputDecomp)
 }
 
 // Invalidates an old session ID if needed. Returns the 'Session' that should be
@@ -215,7 +650,10 @@ func (ss *ServerSessionState) Save(token *SaveSessionToken, data map[interface{}
 // Currently we invalidate whenever the auth ID has changed (login, logout, different user)
 // in order to prevent session fixation attacks.  We also invalidate when asked to via
 // `forceInvalidate`
-func (ss *ServerSessionState) invalidateIfNeeded(sess *Session, decomposed *DecomposedSession) (*Session, error) {
+//
+// If destroyCurrent is false, the caller takes care of the current session when
+// it's invalidated.
+func (ss *ServerSessionState) invalidateIfNeeded(ctx context.Context, sess *Session, decomposed *DecomposedSession, destroyCurrent bool) (*Session, error) {
 	var (
 		authID string
 		err    error
@@ -226,17 +664,19 @@ func (ss *ServerSessionState) invalidateIfNeeded(sess *Session, decomposed *Deco
 	}
 
 	invalidateCurrent := decomposed.Force != DontForceInvalidate || decomposed.AuthID != authID
-	invalidateOthers := decomposed.Force == AllSessionIDsOfLoggedUser && decomposed.AuthID != ""
+	// the sessions of the user owning the current session, including when it's
+	// being logged out (decomposed.AuthID is empty then).
+	invalidateOthers := decomposed.Force == AllSessionIDsOfLoggedUser && authID != ""
 
-	if invalidateCurrent && sess != nil {
-		err = ss.storage.Destroy(sess.ID)
+	if invalidateCurrent && sess != nil && destroyCurrent {
+		err = ss.ctxStorage.DestroyContext(ctx, sess.ID)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	if invalidateOthers && sess != nil {
-		err = ss.storage.DestroyAllOfAuthId(sess.AuthID)
+	if invalidateOthers {
+		err = ss.ctxStorage.DestroyAllOfAuthIdContext(ctx, authID)
 		if err != nil {
 			return nil, err
 		}
@@ -249,21 +689,25 @@ func (ss *ServerSessionState) invalidateIfNeeded(sess *Session, decomposed *Deco
 	return sess, err
 }
 
-func (ss *ServerSessionState) saveSessionOnDb(now time.Time, sess *Session, dec *DecomposedSession) (*Session, error) {
-	var err error
+func (ss *ServerSessionState) saveSessionOnDb(ctx context.Context, token *SaveSessionToken, sess *Session, dec *DecomposedSession) (*Session, error) {
+	var (
+		err error
+		now = token.now
+	)
 
 	if sess == nil && dec.AuthID == "" && len(dec.Decomposed) == 0 {
 		return nil, err
 	}
 
 	if sess == nil {
-		id := strings.TrimRight(
-			base32.StdEncoding.EncodeToString(
-				securecookie.GenerateRandomKey(32)), "=")
-		sess = NewSession(id, dec.AuthID, now)
+		sess = NewSession(newSessionID(), dec.AuthID, now)
 		sess.Values = dec.Decomposed
+		// kept when the session ID is rotated
+		sess.Metadata = token.metadata
+		sess.Binding = token.binding
+		ss.setRotatedAt(sess, now)
 
-		err = ss.storage.Insert(sess)
+		err = ss.ctxStorage.InsertContext(ctx, sess)
 
 		return sess, err
 	}
@@ -271,8 +715,289 @@ func (ss *ServerSessionState) saveSessionOnDb(now time.Time, sess *Session, dec
 	nsess := NewSession(sess.ID, dec.AuthID, now)
 	nsess.CreatedAt = sess.CreatedAt
 	nsess.Values = dec.Decomposed
-
-	err = ss.storage.Replace(nsess)
+	nsess.Metadata = token.metadata
+	nsess.Binding = token.binding
+	ss.setRotatedAt(nsess, token.rotatedAt)
+
+	if deltaStorage, ok := ss.storage.(DeltaStorage); ok && ss.DeltaSave {
+		err = ss.applyDelta(ctx, deltaStorage, token, sess, nsess)
+	} else {
+		err = ss.replaceSession(ctx, token, sess, nsess)
+	}
 
 	return nsess, err
 }
+
+// Verifies the keys of the session values are strings when DeltaSave is used, so a
+// session isn't inserted with values its later deltas can't be applied to.
+func (ss *ServerSessionState) checkDeltaKeys(dec *DecomposedSession) error {
+	if _, ok := ss.storage.(DeltaStorage); !ok || !ss.DeltaSave {
+		return nil
+	}
+	for k := range dec.Decomposed {
+		if _, ok := k.(string); !ok {
+			return fmt.Errorf("sersan: session keys must be strings with DeltaSave, got %T", k)
+		}
+	}
+	return nil
+}
+
+// Saves the values of nsess modified since sess was loaded.
+func (ss *ServerSessionState) applyDelta(ctx context.Context, deltaStorage DeltaStorage, token *SaveSessionToken, sess, nsess *Session) error {
+	nsess.Version = sess.Version + 1
+	updated, deleted := diffValues(token.snapshot, nsess.Values)
+	delta := &SessionDelta{
+		ID:         nsess.ID,
+		Updated:    updated,
+		Deleted:    deleted,
+		AccessedAt: nsess.AccessedAt,
+		Metadata:   nsess.Metadata,
+		Binding:    nsess.Binding,
+	}
+
+	expire := nsess.MaxAge(ss.IdleTimeout, ss.AbsoluteTimeout, token.now)
+	if expire < 0 {
+		expire = 0
+	}
+
+	return applyDeltaContext(ctx, deltaStorage, delta, expire)
+}
+
+// Replaces sess by nsess, following ConflictStrategy when the storage implements
+// VersionReplacer.
+func (ss *ServerSessionState) replaceSession(ctx context.Context, token *SaveSessionToken, sess, nsess *Session) error {
+	nsess.Version = sess.Version + 1
+	replacer, ok := ss.storage.(VersionReplacer)
+	if !ok || ss.ConflictStrategy == LastWriteWins {
+		return ss.ctxStorage.ReplaceContext(ctx, nsess)
+	}
+
+	// values written by this request
+	values := nsess.Values
+	for i := 0; ; i++ {
+		err := replaceIfVersionContext(ctx, replacer, nsess, nsess.Version-1)
+		if _, ok := err.(SessionVersionConflict); !ok || ss.ConflictStrategy != MergeOnConflict || i >= maxMergeRetries {
+			return err
+		}
+
+		current, err := ss.ctxStorage.GetContext(ctx, sess.ID)
+		if err != nil {
+			return err
+		}
+		if current == nil {
+			return SessionDoesNotExist{ID: sess.ID}
+		}
+		if current.AuthID != nsess.AuthID {
+			return SessionVersionConflict{ID: sess.ID}
+		}
+		nsess.Values = mergeValues(token.snapshot, values, current.Values)
+		nsess.Version = current.Version + 1
+	}
+}
+
+// Applies the keys added, updated or deleted in values, compared to base, to a
+// copy of current.
+func mergeValues(base, values, current map[interface{}]interface{}) map[interface{}]interface{} {
+	merged := copyValues(current)
+	updated, deleted := diffValues(base, values)
+	for k, v := range updated {
+		merged[k] = v
+	}
+	for _, k := range deleted {
+		delete(merged, k)
+	}
+
+	return merged
+}
+
+// Returns the values added or updated in values compared to base, and the keys
+// deleted.
+func diffValues(base, values map[interface{}]interface{}) (map[interface{}]interface{}, []interface{}) {
+	updated := make(map[interface{}]interface{})
+	for k, v := range values {
+		if bv, ok := base[k]; !ok || !reflect.DeepEqual(bv, v) {
+			updated[k] = v
+		}
+	}
+	deleted := []interface{}{}
+	for k := range base {
+		if _, ok := values[k]; !ok {
+			deleted = append(deleted, k)
+		}
+	}
+
+	return updated, deleted
+}
+
+// Moves the session to a new session ID. The old session is destroyed, or replaced
+// by a session pointing to the new one during RotationGracePeriod.
+func (ss *ServerSessionState) rotateSession(ctx context.Context, token *SaveSessionToken, sess *Session, dec *DecomposedSession) (*Session, error) {
+	nsess := NewSession(newSessionID(), dec.AuthID, token.now)
+	nsess.CreatedAt = sess.CreatedAt
+	nsess.Values = dec.Decomposed
+	nsess.Metadata = token.metadata
+	nsess.Binding = token.binding
+	ss.setRotatedAt(nsess, token.now)
+
+	if err := ss.ctxStorage.InsertContext(ctx, nsess); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if aliaser := ss.aliaser(ss.RotationGracePeriod); aliaser != nil {
+		err = ss.aliasSession(ctx, aliaser, sess.ID, nsess, ss.RotationGracePeriod)
+	} else if ss.RotationGracePeriod <= 0 {
+		err = ss.ctxStorage.DestroyContext(ctx, sess.ID)
+	} else {
+		err = ss.markRotated(ctx, token, sess, nsess)
+	}
+
+	switch err.(type) {
+	case nil:
+		return nsess, nil
+	case SessionDoesNotExist, SessionVersionConflict:
+		return ss.rotationConflict(ctx, token, sess, nsess, dec)
+	}
+	return nil, err
+}
+
+// Replaces the old session of a rotated session by a session pointing to the new
+// one, without auth ID so it isn't listed nor destroyed with the user's sessions.
+// It fails with SessionVersionConflict if the old session was replaced since it
+// was loaded, e.g. rotated by a concurrent request. Storages not implementing
+// VersionReplacer can't check it atomically, the old session is only verified not
+// to be rotated already.
+func (ss *ServerSessionState) markRotated(ctx context.Context, token *SaveSessionToken, sess, nsess *Session) error {
+	rotated := NewSession(sess.ID, "", sess.CreatedAt)
+	rotated.AccessedAt = token.now
+	rotated.Values[RotatedToKey] = nsess.ID
+	rotated.Version = sess.Version + 1
+
+	var err error
+	if replacer, ok := ss.storage.(VersionReplacer); ok {
+		err = replaceIfVersionContext(ctx, replacer, rotated, sess.Version)
+	} else {
+		var current *Session
+		current, err = ss.ctxStorage.GetContext(ctx, sess.ID)
+		if err != nil {
+			return err
+		}
+		if current == nil {
+			return SessionDoesNotExist{ID: sess.ID}
+		}
+		if isRotated(current) {
+			return SessionVersionConflict{ID: sess.ID}
+		}
+		err = ss.ctxStorage.ReplaceContext(ctx, rotated)
+	}
+	if err != nil {
+		return err
+	}
+
+	// expire it with the grace period, otherwise it's destroyed when loaded after
+	if toucher, ok := ss.storage.(Toucher); ok {
+		if err = touchContext(ctx, toucher, rotated.ID, token.now, durationSeconds(ss.RotationGracePeriod)); err != nil {
+			ss.logf("sersan: can't expire rotated session: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// Called when the old session of a rotated session was rotated or replaced by a
+// concurrent request. The new session is dropped and the data of the request is
+// saved to the session the old session ID leads to now.
+func (ss *ServerSessionState) rotationConflict(ctx context.Context, token *SaveSessionToken, sess, nsess *Session, dec *DecomposedSession) (*Session, error) {
+	if err := ss.ctxStorage.DestroyContext(ctx, nsess.ID); err != nil {
+		return nil, err
+	}
+
+	current, err := ss.ctxStorage.GetContext(ctx, sess.ID)
+	if err == nil && current == nil {
+		current, err = ss.loadAlias(ctx, sess.ID)
+	} else if err == nil && isRotated(current) {
+		current, err = ss.loadRotated(ctx, current, token.now)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		return nil, SessionDoesNotExist{ID: sess.ID}
+	}
+
+	// only replaced, it's rotated by a later request
+	if current.ID == sess.ID {
+		return ss.saveSessionOnDb(ctx, token, sess, dec)
+	}
+
+	rtoken := *token
+	rtoken.sess = current
+	rtoken.rotatedAt = rotatedAt(current)
+	if !rtoken.isModified(dec) {
+		return current, nil
+	}
+	return ss.saveSessionOnDb(ctx, &rtoken, current, dec)
+}
+
+// Returns the storage as Aliaser if it implements it and grace is enabled.
+func (ss *ServerSessionState) aliaser(grace time.Duration) Aliaser {
+	if grace <= 0 {
+		return nil
+	}
+	aliaser, _ := ss.storage.(Aliaser)
+	return aliaser
+}
+
+// Makes the session id an alias of nsess for the grace period, or destroys it if
+// there is no new session.
+func (ss *ServerSessionState) aliasSession(ctx context.Context, aliaser Aliaser, id string, nsess *Session, grace time.Duration) error {
+	if nsess == nil {
+		return ss.ctxStorage.DestroyContext(ctx, id)
+	}
+
+	return aliasContext(ctx, aliaser, id, nsess.ID, durationSeconds(grace))
+}
+
+// Returns the duration in whole seconds, rounded up.
+func durationSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// Saves the rotation time in a copy of the session values, they may be the map
+// of the handler.
+func (ss *ServerSessionState) setRotatedAt(sess *Session, t time.Time) {
+	if ss.RotationInterval > 0 {
+		sess.Values = copyValues(sess.Values)
+		sess.Values[RotatedAtKey] = t.Unix()
+	}
+}
+
+func newSessionID() string {
+	return strings.TrimRight(
+		base32.StdEncoding.EncodeToString(
+			securecookie.GenerateRandomKey(32)), "=")
+}
+
+// Refresh the AccessedAt of an unmodified session, without rewriting its data.
+func (ss *ServerSessionState) touchSession(ctx context.Context, toucher Toucher, now time.Time, sess *Session) (*Session, error) {
+	nsess := NewSession(sess.ID, sess.AuthID, sess.CreatedAt)
+	nsess.AccessedAt = now
+	nsess.Values = sess.Values
+	nsess.Metadata = sess.Metadata
+	nsess.Binding = sess.Binding
+
+	expire := nsess.MaxAge(ss.IdleTimeout, ss.AbsoluteTimeout, now)
+	if expire < 0 {
+		expire = 0
+	}
+
+	return nsess, touchContext(ctx, toucher, nsess.ID, now, expire)
+}
+
+func copyValues(values map[interface{}]interface{}) map[interface{}]interface{} {
+	m := make(map[interface{}]interface{}, len(values))
+	for k, v := range values {
+		m[k] = v
+	}
+	return m
+}
@@ -1,6 +1,7 @@
 package sersan
 
 import (
+	"context"
 	"errors"
 	"reflect"
 	"testing"
@@ -44,6 +45,20 @@ func TestLoadSession(t *testing.T) {
 	}
 }
 
+func TestLoadSessionStorageError(t *testing.T) {
+	ss := NewServerSessionState(&tntStorage{})
+	if _, _, err := ss.Load("123456789-123456789-123456789-12"); err != tntError {
+		t.Errorf("Expected Load to return storage error, got: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ss = NewServerSessionState(NewStorageRecorder())
+	if _, _, err := ss.LoadContext(ctx, "123456789-123456789-123456789-12"); err != context.Canceled {
+		t.Errorf("Expected LoadContext to return context.Canceled, got: %v", err)
+	}
+}
+
 func TestLoadSessionExists(t *testing.T) {
 	sess := NewSession("123456789-123456789-123456789-12", "auth-id", time.Now().UTC())
 	sess.Values["foo"] = "bar"
@@ -259,6 +274,95 @@ func TestComplexSaveSession(t *testing.T) {
 	}
 }
 
+func TestSaveSessionUnmodified(t *testing.T) {
+	now := time.Now().UTC()
+	sess := NewSession("123456789-123456789-123456789-12", "john", now.Add(-time.Hour))
+	sess.AccessedAt = now.Add(-30 * time.Second)
+	sess.Values["foo"] = "bar"
+	storage := PrepareStorageRecorder([]*Session{sess})
+	ss := NewServerSessionState(storage)
+
+	data, token, err := ss.Load(sess.ID)
+	if err != nil {
+		t.Fatalf("Load session failed with error: %v", err)
+	}
+	storage.GetOperations()
+
+	// only read, accessed recently
+	_ = data["foo"]
+	sess1, err := ss.Save(token, data)
+	if err != nil || sess1 == nil {
+		t.Fatalf("expected save return no nil session and non nil error, returned %v", err)
+	}
+	if sess1.ID != sess.ID || !reflect.DeepEqual(sess1.Values, map[interface{}]interface{}{"foo": "bar"}) {
+		t.Fatal("expected unmodified session to be returned")
+	}
+	if op := storage.GetOperations(); len(op) != 0 {
+		t.Fatalf("expected no storage operation for unmodified session, got %d", len(op))
+	}
+
+	// only read, but TouchInterval has passed
+	ss.TouchInterval = 10 * time.Second
+	data, token, _ = ss.Load(sess.ID)
+	storage.GetOperations()
+	sess2, err := ss.Save(token, data)
+	if err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	if op := storage.GetOperations(); !reflect.DeepEqual(op, []*RecorderOperation{
+		&RecorderOperation{Tag: "Touch", ID: sess.ID},
+	}) {
+		t.Fatal("expected a single operation Touch to touch the session")
+	}
+	if !sess2.AccessedAt.Equal(token.now) {
+		t.Fatal("expected touched session to have updated AccessedAt")
+	}
+	if stored, _ := storage.Get(sess.ID); !stored.AccessedAt.Equal(token.now) || !stored.Equal(sess) {
+		t.Fatal("expected Touch to only update AccessedAt of the stored session")
+	}
+
+	// storage without Touch support
+	ss2 := NewServerSessionState(struct{ Storage }{storage})
+	ss2.TouchInterval = 0
+	data, token, _ = ss2.Load(sess.ID)
+	storage.GetOperations()
+	sess2, err = ss2.Save(token, data)
+	if err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	if op := storage.GetOperations(); !reflect.DeepEqual(op, []*RecorderOperation{
+		&RecorderOperation{Tag: "Replace", Session: sess2},
+	}) {
+		t.Fatal("expected a single operation Replace when storage doesn't implement Toucher")
+	}
+
+	// modified
+	ss.TouchInterval = time.Hour
+	data, token, _ = ss.Load(sess.ID)
+	storage.GetOperations()
+	data["foo"] = "baz"
+	sess3, err := ss.Save(token, data)
+	if err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	if op := storage.GetOperations(); !reflect.DeepEqual(op, []*RecorderOperation{
+		&RecorderOperation{Tag: "Replace", Session: sess3},
+	}) {
+		t.Fatal("expected a single operation Replace for modified session")
+	}
+
+	// deleted key
+	data, token, _ = ss.Load(sess.ID)
+	storage.GetOperations()
+	delete(data, "foo")
+	if _, err = ss.Save(token, data); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	if op := storage.GetOperations(); len(op) != 1 || op[0].Tag != "Replace" {
+		t.Fatal("expected a single operation Replace when a key is deleted")
+	}
+}
+
 func copyMap(m map[interface{}]interface{}) map[interface{}]interface{} {
 	m1 := make(map[interface{}]interface{})
 	for k, v := range m {
@@ -266,3 +370,550 @@ func copyMap(m map[interface{}]interface{}) map[interface{}]interface{} {
 	}
 	return m1
 }
+
+func TestListSessions(t *testing.T) {
+	now := time.Now().UTC()
+	active := NewSession("session-1", "john", now)
+	current := NewSession("session-2", "john", now)
+	expired := NewSession("session-3", "john", now.Add(-time.Hour))
+	other := NewSession("session-4", "jane", now)
+	storage := PrepareStorageRecorder([]*Session{active, current, expired, other})
+	ss := NewServerSessionState(storage)
+	ss.IdleTimeout = 60
+
+	sessions, err := ss.ListSessions("john")
+	if err != nil {
+		t.Fatalf("ListSessions returned error: %v", err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("expected ListSessions to return 2 active sessions, returned %d", len(sessions))
+	}
+	for _, sess := range sessions {
+		if sess.ID != active.ID && sess.ID != current.ID {
+			t.Fatalf("unexpected session %s returned by ListSessions", sess.ID)
+		}
+	}
+
+	if err = ss.RevokeSession("john", other.ID); err != (SessionDoesNotExist{ID: other.ID}) {
+		t.Fatalf("RevokeSession of other user's session must return SessionDoesNotExist, returned %v", err)
+	}
+	if err = ss.RevokeSession("john", active.ID); err != nil {
+		t.Fatalf("RevokeSession returned error: %v", err)
+	}
+	if sess, _ := storage.Get(active.ID); sess != nil {
+		t.Fatal("expected session to be revoked")
+	}
+
+	storage.Insert(active)
+	if err = ss.DestroyOtherSessions("john", current.ID); err != nil {
+		t.Fatalf("DestroyOtherSessions returned error: %v", err)
+	}
+	if sessions, _ = ss.ListSessions("john"); len(sessions) != 1 || sessions[0].ID != current.ID {
+		t.Fatal("expected DestroyOtherSessions to keep only the current session")
+	}
+	if sess, _ := storage.Get(other.ID); sess == nil {
+		t.Fatal("DestroyOtherSessions must not destroy sessions of other users")
+	}
+}
+
+func TestListSessionsNotSupported(t *testing.T) {
+	ss := NewServerSessionState(struct{ Storage }{NewStorageRecorder()})
+
+	if _, err := ss.ListSessions("john"); err != ErrNotSupported {
+		t.Fatalf("expected ListSessions to return ErrNotSupported, returned %v", err)
+	}
+	if err := ss.DestroyOtherSessions("john", "session-1"); err != ErrNotSupported {
+		t.Fatalf("expected DestroyOtherSessions to return ErrNotSupported, returned %v", err)
+	}
+}
+
+func TestRotateSessionID(t *testing.T) {
+	now := time.Now().UTC()
+	sess := NewSession("session-1", "john", now.Add(-2*time.Hour))
+	sess.Values["foo"] = "bar"
+	storage := PrepareStorageRecorder([]*Session{sess})
+	// hide Aliaser, the old session is replaced by a tombstone
+	ss := NewServerSessionState(struct {
+		Storage
+		AuthIndex
+	}{storage, storage})
+	ss.RotationInterval = time.Hour
+	ss.RotationGracePeriod = time.Minute
+
+	data, token, _ := ss.Load(sess.ID)
+	if _, ok := data[RotatedAtKey]; ok {
+		t.Fatal("rotation time must not be visible in the session data")
+	}
+	storage.GetOperations()
+	nsess, err := ss.Save(token, data)
+	if err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	if nsess.ID == sess.ID || nsess.AuthID != "john" || nsess.Values["foo"] != "bar" {
+		t.Fatal("expected session to be rotated to a new ID with the same data")
+	}
+	if !nsess.CreatedAt.Equal(sess.CreatedAt) {
+		t.Fatal("rotated session must keep its CreatedAt")
+	}
+	op := storage.GetOperations()
+	if len(op) != 3 || op[0].Tag != "Insert" || op[1].Tag != "Get" || op[2].Tag != "Replace" || op[2].Session.Values[RotatedToKey] != nsess.ID {
+		t.Fatal("expected operations Insert, Get, Replace the old session pointing to the new one")
+	}
+	if op[2].Session.AuthID != "" {
+		t.Fatal("rotated session must not keep the auth ID")
+	}
+	if _, ok := data[RotatedAtKey]; ok {
+		t.Fatal("Save must not modify the session data")
+	}
+
+	// not due yet
+	data, token, _ = ss.Load(nsess.ID)
+	data["foo"] = "baz"
+	if sess2, _ := ss.Save(token, data); sess2.ID != nsess.ID {
+		t.Fatal("session must not be rotated before RotationInterval")
+	}
+
+	// the old ID loads the new session during the grace period
+	data, token, _ = ss.Load(sess.ID)
+	if token.sess == nil || token.sess.ID != nsess.ID || data["foo"] != "baz" {
+		t.Fatal("expected old session ID to load the new session during the grace period")
+	}
+	if sessions, _ := ss.ListSessions("john"); len(sessions) != 1 || sessions[0].ID != nsess.ID {
+		t.Fatal("ListSessions must not return rotated sessions")
+	}
+
+	old, _ := storage.Get(sess.ID)
+	old.AccessedAt = now.Add(-2 * time.Minute)
+	if _, token, _ = ss.Load(sess.ID); token.sess != nil {
+		t.Fatal("expected old session ID to be invalid after the grace period")
+	}
+	if gsess, _ := storage.Get(sess.ID); gsess != nil {
+		t.Fatal("expected rotated session to be destroyed after the grace period")
+	}
+}
+
+func TestRotateSessionIDConcurrently(t *testing.T) {
+	now := time.Now().UTC()
+	for name, hide := range map[string]func(*StorageRecorder) Storage{
+		"Aliaser": func(s *StorageRecorder) Storage { return s },
+		"VersionReplacer": func(s *StorageRecorder) Storage {
+			return struct {
+				Storage
+				VersionReplacer
+			}{s, s}
+		},
+		"Storage": func(s *StorageRecorder) Storage { return struct{ Storage }{s} },
+	} {
+		sess := NewSession("session-1", "john", now.Add(-2*time.Hour))
+		sess.Values["foo"] = "bar"
+		storage := PrepareStorageRecorder([]*Session{sess})
+		ss := NewServerSessionState(hide(storage))
+		ss.RotationInterval = time.Hour
+		ss.RotationGracePeriod = time.Minute
+
+		// two requests sent with the same cookie
+		data1, token1, _ := ss.Load(sess.ID)
+		data2, token2, _ := ss.Load(sess.ID)
+		data1 = copyValues(data1)
+		data2 = copyValues(data2)
+		data2["baz"] = "qux"
+
+		nsess1, err := ss.Save(token1, data1)
+		if err != nil {
+			t.Fatalf("%s: Save returned error: %v", name, err)
+		}
+		nsess2, err := ss.Save(token2, data2)
+		if err != nil {
+			t.Fatalf("%s: Save returned error: %v", name, err)
+		}
+		if nsess2.ID != nsess1.ID {
+			t.Fatalf("%s: expected the second request to use the session rotated by the first", name)
+		}
+		for id, stored := range storage.sessions {
+			if id != nsess1.ID && !isRotated(stored) {
+				t.Fatalf("%s: expected a single active session, found %s", name, id)
+			}
+		}
+
+		data, token, _ := ss.Load(sess.ID)
+		if token.sess == nil || token.sess.ID != nsess1.ID || data["baz"] != "qux" {
+			t.Fatalf("%s: expected old session ID to load the session with the data of both requests", name)
+		}
+	}
+}
+
+func TestConflictStrategy(t *testing.T) {
+	newState := func(strategy ConflictStrategy) (*StorageRecorder, *ServerSessionState, *Session) {
+		sess := NewSession("session-1", "john", time.Now().UTC())
+		sess.Values["a"] = "a"
+		sess.Values["b"] = "b"
+		storage := PrepareStorageRecorder([]*Session{sess})
+		ss := NewServerSessionState(storage)
+		ss.ConflictStrategy = strategy
+		return storage, ss, sess
+	}
+	// the recorder shares the session values between the loads
+	load := func(ss *ServerSessionState, id string) (map[interface{}]interface{}, *SaveSessionToken) {
+		data, token, _ := ss.Load(id)
+		return copyValues(data), token
+	}
+
+	storage, ss, sess := newState(LastWriteWins)
+	data1, token1 := load(ss, sess.ID)
+	data2, token2 := load(ss, sess.ID)
+	data1["a"] = "A"
+	data2["b"] = "B"
+	ss.Save(token1, data1)
+	storage.GetOperations()
+	nsess, err := ss.Save(token2, data2)
+	if err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	if op := storage.GetOperations(); len(op) != 1 || op[0].Tag != "Replace" {
+		t.Fatal("expected operation Replace with LastWriteWins")
+	}
+	if nsess.Version != 1 || nsess.Values["a"] != "a" {
+		t.Fatal("expected the last write to win")
+	}
+
+	_, ss, sess = newState(FailOnConflict)
+	data1, token1 = load(ss, sess.ID)
+	data2, token2 = load(ss, sess.ID)
+	data1["a"] = "A"
+	data2["b"] = "B"
+	if nsess, err = ss.Save(token1, data1); err != nil || nsess.Version != 1 {
+		t.Fatalf("expected first save to succeed, returned %v", err)
+	}
+	if _, err = ss.Save(token2, data2); err != (SessionVersionConflict{ID: sess.ID}) {
+		t.Fatalf("expected SessionVersionConflict, Save returned %v", err)
+	}
+
+	storage, ss, sess = newState(MergeOnConflict)
+	data1, token1 = load(ss, sess.ID)
+	data2, token2 = load(ss, sess.ID)
+	data1["a"] = "A"
+	data1["c"] = "C"
+	data2["b"] = "B"
+	delete(data2, "a")
+	ss.Save(token1, data1)
+	if nsess, err = ss.Save(token2, data2); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	expected := map[interface{}]interface{}{"b": "B", "c": "C"}
+	if !reflect.DeepEqual(nsess.Values, expected) || nsess.Version != 2 {
+		t.Fatalf("expected merged values %v, got %v", expected, nsess.Values)
+	}
+	if stored, _ := storage.Get(sess.ID); stored != nsess {
+		t.Fatal("expected merged session to be saved")
+	}
+
+	// can't merge a session whose auth ID changed
+	_, ss, sess = newState(MergeOnConflict)
+	data2, token2 = load(ss, sess.ID)
+	data2["b"] = "B"
+	// replaced behind our back, keeping the session ID
+	ss.storage.Replace(&Session{ID: sess.ID, AuthID: "jane", Version: 1})
+	if _, err = ss.Save(token2, data2); err != (SessionVersionConflict{ID: sess.ID}) {
+		t.Fatalf("expected SessionVersionConflict, Save returned %v", err)
+	}
+}
+
+func TestDeltaSave(t *testing.T) {
+	sess := NewSession("session-1", "john", time.Now().UTC())
+	sess.Values["a"] = "a"
+	sess.Values["b"] = "b"
+	storage := PrepareStorageRecorder([]*Session{sess})
+	ss := NewServerSessionState(storage)
+	ss.DeltaSave = true
+
+	// the recorder shares the session values between the loads
+	data1, token1, _ := ss.Load(sess.ID)
+	data1 = copyValues(data1)
+	data2, token2, _ := ss.Load(sess.ID)
+	data2 = copyValues(data2)
+	data1["a"] = "A"
+	data1["c"] = "C"
+	delete(data2, "b")
+
+	storage.GetOperations()
+	if _, err := ss.Save(token1, data1); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	op := storage.GetOperations()
+	if len(op) != 1 || op[0].Tag != "ApplyDelta" {
+		t.Fatal("expected operation ApplyDelta")
+	}
+	expected := &SessionDelta{
+		ID:         sess.ID,
+		Updated:    map[interface{}]interface{}{"a": "A", "c": "C"},
+		Deleted:    []interface{}{},
+		AccessedAt: token1.now,
+	}
+	if !reflect.DeepEqual(op[0].Delta, expected) {
+		t.Fatalf("expected delta %+v, got %+v", expected, op[0].Delta)
+	}
+
+	if _, err := ss.Save(token2, data2); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	stored, _ := storage.Get(sess.ID)
+	if !reflect.DeepEqual(stored.Values, map[interface{}]interface{}{"a": "A", "c": "C"}) || stored.Version != 2 {
+		t.Fatalf("expected both deltas to be applied, got %v", stored.Values)
+	}
+
+	// rejected before anything is written
+	data, token, _ := ss.Load(sess.ID)
+	data[42] = "answer"
+	storage.GetOperations()
+	if _, err := ss.Save(token, data); err == nil {
+		t.Fatal("expected Save to fail for a non-string key with DeltaSave")
+	}
+	if op := storage.GetOperations(); len(op) != 0 {
+		t.Fatal("expected no storage operation for a non-string key")
+	}
+}
+
+func TestRotateSessionIDWithAlias(t *testing.T) {
+	now := time.Now().UTC()
+	sess := NewSession("session-1", "john", now.Add(-2*time.Hour))
+	sess.Values["foo"] = "bar"
+	storage := PrepareStorageRecorder([]*Session{sess})
+	ss := NewServerSessionState(storage)
+	ss.RotationInterval = time.Hour
+	ss.RotationGracePeriod = 1500 * time.Millisecond
+
+	data, token, _ := ss.Load(sess.ID)
+	storage.GetOperations()
+	nsess, err := ss.Save(token, data)
+	if err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	op := storage.GetOperations()
+	if len(op) != 2 || op[0].Tag != "Insert" || !reflect.DeepEqual(op[1], &RecorderOperation{Tag: "Alias", ID: sess.ID, Target: nsess.ID}) {
+		t.Fatal("expected operations Insert, Alias the old session ID to the new one")
+	}
+	if alias := storage.aliases[sess.ID]; alias.expires.Sub(now) < 2*time.Second {
+		t.Fatal("expected alias TTL to be rounded up to whole seconds")
+	}
+
+	data, token, _ = ss.Load(sess.ID)
+	if token.sess == nil || token.sess.ID != nsess.ID || data["foo"] != "bar" {
+		t.Fatal("expected old session ID to load the new session during the grace period")
+	}
+
+	storage.aliases[sess.ID] = recorderAlias{target: nsess.ID, expires: now.Add(-time.Second)}
+	if _, token, _ = ss.Load(sess.ID); token.sess != nil {
+		t.Fatal("expected old session ID to be invalid after the grace period")
+	}
+}
+
+func TestInvalidationGracePeriod(t *testing.T) {
+	now := time.Now().UTC()
+	sess := NewSession("session-1", "", now)
+	sess.Values["foo"] = "bar"
+	storage := PrepareStorageRecorder([]*Session{sess})
+	ss := NewServerSessionState(storage)
+	ss.InvalidationGracePeriod = 10 * time.Second
+
+	// login
+	data, token, _ := ss.Load(sess.ID)
+	data[ss.AuthKey] = "john"
+	storage.GetOperations()
+	nsess, err := ss.Save(token, data)
+	if err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	if nsess.ID == sess.ID || nsess.AuthID != "john" {
+		t.Fatal("expected session to be migrated to a new ID on login")
+	}
+	op := storage.GetOperations()
+	if len(op) != 2 || op[0].Tag != "Insert" || !reflect.DeepEqual(op[1], &RecorderOperation{Tag: "Alias", ID: sess.ID, Target: nsess.ID}) {
+		t.Fatal("expected operations Insert, Alias the old session ID to the new one")
+	}
+
+	// a parallel request sent with the old cookie
+	data, token, _ = ss.Load(sess.ID)
+	if token.sess == nil || token.sess.ID != nsess.ID || data[ss.AuthKey] != "john" {
+		t.Fatal("expected old session ID to load the new session during the grace period")
+	}
+
+	// logout everywhere never keeps an alias
+	data[ForceInvalidateKey] = AllSessionIDsOfLoggedUser
+	storage.GetOperations()
+	if _, err = ss.Save(token, data); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	for _, o := range storage.GetOperations() {
+		if o.Tag == "Alias" {
+			t.Fatal("expected no alias when all sessions are invalidated")
+		}
+	}
+
+	// without grace period the old session is destroyed
+	sess = NewSession("session-2", "", now)
+	storage = PrepareStorageRecorder([]*Session{sess})
+	ss = NewServerSessionState(storage)
+	data, token, _ = ss.Load(sess.ID)
+	data[ss.AuthKey] = "john"
+	storage.GetOperations()
+	if _, err = ss.Save(token, data); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	if op := storage.GetOperations(); len(op) != 2 || !reflect.DeepEqual(op[0], &RecorderOperation{Tag: "Destroy", ID: sess.ID}) || op[1].Tag != "Insert" {
+		t.Fatal("expected operations Destroy, Insert")
+	}
+}
+
+func TestRotateSessionIDWithoutGrace(t *testing.T) {
+	now := time.Now().UTC()
+	sess := NewSession("session-1", "", now.Add(-2*time.Hour))
+	// saved by JSONSerializer
+	sess.Values[RotatedAtKey] = float64(now.Add(-30 * time.Minute).Unix())
+	sess.Values["foo"] = "bar"
+	storage := PrepareStorageRecorder([]*Session{sess})
+	ss := NewServerSessionState(storage)
+	ss.RotationInterval = time.Hour
+
+	data, token, _ := ss.Load(sess.ID)
+	if nsess, _ := ss.Save(token, data); nsess.ID != sess.ID {
+		t.Fatal("session must not be rotated before RotationInterval")
+	}
+
+	ss.RotationInterval = 10 * time.Minute
+	data, token, _ = ss.Load(sess.ID)
+	storage.GetOperations()
+	nsess, err := ss.Save(token, data)
+	if err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	if op := storage.GetOperations(); len(op) != 2 || op[0].Tag != "Insert" || !reflect.DeepEqual(op[1], &RecorderOperation{Tag: "Destroy", ID: sess.ID}) {
+		t.Fatal("expected operations Insert, Destroy")
+	}
+	if nsess.Values[RotatedAtKey] != token.now.Unix() {
+		t.Fatal("expected rotation time to be saved in the new session")
+	}
+}
+
+type ctxKey struct{}
+
+// StorageRecorder implementing the context-aware variants of the extensions,
+// recording the contexts they are called with.
+type contextRecorder struct {
+	*StorageRecorder
+	contexts []context.Context
+}
+
+func (s *contextRecorder) TouchContext(ctx context.Context, id string, accessedAt time.Time, expire int) error {
+	s.contexts = append(s.contexts, ctx)
+	return s.Touch(id, accessedAt, expire)
+}
+
+func (s *contextRecorder) AliasContext(ctx context.Context, id, targetId string, ttl int) error {
+	s.contexts = append(s.contexts, ctx)
+	return s.Alias(id, targetId, ttl)
+}
+
+func (s *contextRecorder) ResolveAliasContext(ctx context.Context, id string) (string, error) {
+	s.contexts = append(s.contexts, ctx)
+	return s.ResolveAlias(id)
+}
+
+func (s *contextRecorder) ReplaceIfVersionContext(ctx context.Context, sess *Session, version int64) error {
+	s.contexts = append(s.contexts, ctx)
+	return s.ReplaceIfVersion(sess, version)
+}
+
+func (s *contextRecorder) ApplyDeltaContext(ctx context.Context, delta *SessionDelta, expire int) error {
+	s.contexts = append(s.contexts, ctx)
+	return s.ApplyDelta(delta, expire)
+}
+
+func (s *contextRecorder) ListByAuthIdContext(ctx context.Context, authId string) ([]*Session, error) {
+	s.contexts = append(s.contexts, ctx)
+	return s.ListByAuthId(authId)
+}
+
+func (s *contextRecorder) DestroyByAuthIdExceptContext(ctx context.Context, authId, keepId string) error {
+	s.contexts = append(s.contexts, ctx)
+	return s.DestroyByAuthIdExcept(authId, keepId)
+}
+
+// Fails unless each context-aware method was called with a context holding the
+// value of ctxKey.
+func (s *contextRecorder) assertContexts(t *testing.T, calls int) {
+	if len(s.contexts) != calls {
+		t.Fatalf("expected %d calls of context-aware methods, got %d", calls, len(s.contexts))
+	}
+	for _, ctx := range s.contexts {
+		if ctx.Value(ctxKey{}) != "request" {
+			t.Fatal("expected the context of the request to be passed to the storage")
+		}
+	}
+	s.contexts = nil
+}
+
+func TestExtensionsContext(t *testing.T) {
+	sess := NewSession("session-1", "john", time.Now().UTC())
+	sess.Values["foo"] = "bar"
+	storage := &contextRecorder{StorageRecorder: PrepareStorageRecorder([]*Session{sess})}
+	ss := NewServerSessionState(storage)
+	ss.TouchInterval = 0
+	ctx := context.WithValue(context.Background(), ctxKey{}, "request")
+
+	// touched
+	data, token, _ := ss.LoadContext(ctx, sess.ID)
+	if _, err := ss.SaveContext(ctx, token, data); err != nil {
+		t.Fatalf("SaveContext returned error: %v", err)
+	}
+	storage.assertContexts(t, 1)
+
+	// aliased on login, then resolved
+	ss.InvalidationGracePeriod = time.Minute
+	data, token, _ = ss.LoadContext(ctx, sess.ID)
+	data[ss.AuthKey] = "jane"
+	if _, err := ss.SaveContext(ctx, token, data); err != nil {
+		t.Fatalf("SaveContext returned error: %v", err)
+	}
+	if _, token, _ = ss.LoadContext(ctx, sess.ID); token.sess == nil {
+		t.Fatal("expected old session ID to load the new session")
+	}
+	storage.assertContexts(t, 2)
+
+	// replaced if not modified concurrently
+	ss.ConflictStrategy = FailOnConflict
+	data, token, _ = ss.LoadContext(ctx, sess.ID)
+	data["foo"] = "baz"
+	if _, err := ss.SaveContext(ctx, token, data); err != nil {
+		t.Fatalf("SaveContext returned error: %v", err)
+	}
+	storage.assertContexts(t, 2)
+
+	// only the modified values saved
+	ss.DeltaSave = true
+	data, token, _ = ss.LoadContext(ctx, sess.ID)
+	data["foo"] = "qux"
+	if _, err := ss.SaveContext(ctx, token, data); err != nil {
+		t.Fatalf("SaveContext returned error: %v", err)
+	}
+	storage.assertContexts(t, 2)
+
+	// sessions listed and destroyed through the auth index
+	sessions, err := ss.ListSessionsContext(ctx, "jane")
+	if err != nil || len(sessions) != 1 {
+		t.Fatalf("expected ListSessionsContext to return 1 session, returned %d, %v", len(sessions), err)
+	}
+	if err = ss.DestroyOtherSessionsContext(ctx, "jane", sessions[0].ID); err != nil {
+		t.Fatalf("DestroyOtherSessionsContext returned error: %v", err)
+	}
+	storage.assertContexts(t, 2)
+
+	// canceled before revoking the session
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err = ss.RevokeSessionContext(canceled, "jane", sessions[0].ID); err != context.Canceled {
+		t.Fatalf("expected RevokeSessionContext to return context.Canceled, returned %v", err)
+	}
+	if gsess, _ := storage.Get(sessions[0].ID); gsess == nil {
+		t.Fatal("RevokeSessionContext must not destroy the session with canceled context")
+	}
+}
@@ -0,0 +1,130 @@
+package sql
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Dialect of the SQL database used by SQLStore.
+type Dialect int
+
+const (
+	PostgreSQL Dialect = iota + 1
+	MySQL
+	SQLite
+)
+
+func (d Dialect) String() string {
+	switch d {
+	case PostgreSQL:
+		return "postgresql"
+	case MySQL:
+		return "mysql"
+	case SQLite:
+		return "sqlite"
+	}
+	return "unknown dialect " + strconv.Itoa(int(d))
+}
+
+func (d Dialect) valid() bool {
+	return d == PostgreSQL || d == MySQL || d == SQLite
+}
+
+func (d Dialect) blobType() string {
+	switch d {
+	case PostgreSQL:
+		return "BYTEA"
+	case MySQL:
+		return "LONGBLOB"
+	}
+	return "BLOB"
+}
+
+// rebind replaces the '?' placeholders in query with the dialect's bind variables.
+func (d Dialect) rebind(query string) string {
+	if d != PostgreSQL {
+		return query
+	}
+
+	var (
+		b strings.Builder
+		n int
+	)
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// isUniqueViolation reports whether err was caused by inserting a duplicate primary
+// key. We don't want to depend on the drivers, so this looks at the SQLSTATE if
+// the driver exposes it, even wrapped, and falls back to the well known error
+// messages.
+func (d Dialect) isUniqueViolation(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	msg := err.Error()
+	switch d {
+	case PostgreSQL:
+		var e interface{ SQLState() string }
+		if errors.As(err, &e) {
+			return e.SQLState() == "23505"
+		}
+		return strings.Contains(msg, "23505") || strings.Contains(msg, "duplicate key value")
+	case MySQL:
+		return strings.Contains(msg, "Error 1062") || strings.Contains(msg, "Duplicate entry")
+	case SQLite:
+		return strings.Contains(msg, "UNIQUE constraint failed") || strings.Contains(msg, "is not unique")
+	}
+
+	return false
+}
+
+// Schema migrations, the n-th element bring the schema to version n+1. Never
+// edit an existing migration, append a new one instead.
+var migrations = []func(d Dialect, table string) []string{
+	func(d Dialect, table string) []string {
+		return []string{
+			"CREATE TABLE " + table + " (" +
+				"id VARCHAR(128) NOT NULL PRIMARY KEY, " +
+				"auth_id VARCHAR(255) NOT NULL DEFAULT '', " +
+				"data " + d.blobType() + " NOT NULL, " +
+				"created_at BIGINT NOT NULL, " +
+				"accessed_at BIGINT NOT NULL)",
+			"CREATE INDEX " + table + "_auth_id_idx ON " + table + " (auth_id)",
+		}
+	},
+	// session metadata
+	func(d Dialect, table string) []string {
+		return []string{
+			"ALTER TABLE " + table + " ADD COLUMN ip VARCHAR(64) NOT NULL DEFAULT ''",
+			"ALTER TABLE " + table + " ADD COLUMN last_seen_ip VARCHAR(64) NOT NULL DEFAULT ''",
+			"ALTER TABLE " + table + " ADD COLUMN user_agent VARCHAR(512) NOT NULL DEFAULT ''",
+			"ALTER TABLE " + table + " ADD COLUMN label VARCHAR(255) NOT NULL DEFAULT ''",
+		}
+	},
+	// session binding
+	func(d Dialect, table string) []string {
+		return []string{
+			"ALTER TABLE " + table + " ADD COLUMN binding VARCHAR(255) NOT NULL DEFAULT ''",
+		}
+	},
+}
+
+// Schema returns the statements needed to create the sessions table from scratch,
+// for those who prefer to manage the schema with their own migration tool.
+func (d Dialect) Schema(table string) []string {
+	var stmts []string
+	for _, m := range migrations {
+		stmts = append(stmts, m(d, table)...)
+	}
+	return stmts
+}
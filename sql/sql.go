@@ -0,0 +1,262 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/syaiful6/sersan"
+)
+
+var tableNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// SQLStore implements sersan.Storage using a SQL database via database/sql. The
+// sessions are saved in a single table, with the values encoded by serializer and
+// the timestamps stored as unix time in nanoseconds. Use Migrate to create the
+// table, or Dialect.Schema if you manage your schema yourself.
+type SQLStore struct {
+	DB                           *sql.DB
+	IdleTimeout, AbsoluteTimeout int
+	dialect                      Dialect
+	table                        string
+	serializer                   sersan.SessionSerializer
+}
+
+// NewSQLStore instantiates a SQLStore with the provided database handle. The
+// driver used to open db must match the dialect.
+func NewSQLStore(db *sql.DB, dialect Dialect) (*SQLStore, error) {
+	if !dialect.valid() {
+		return nil, fmt.Errorf("sersan/sql: %s", dialect)
+	}
+
+	return &SQLStore{
+		DB:              db,
+		IdleTimeout:     604800,  // 7 days
+		AbsoluteTimeout: 5184000, // 60 days
+		dialect:         dialect,
+		table:           "sersan_sessions",
+		serializer:      sersan.GobSerializer{},
+	}, nil
+}
+
+// SetTableName change the name of sessions table, `sersan_sessions` by default.
+func (s *SQLStore) SetTableName(name string) error {
+	if !tableNameRegexp.MatchString(name) {
+		return fmt.Errorf("sersan/sql: invalid table name: %s", name)
+	}
+	s.table = name
+	return nil
+}
+
+func (s *SQLStore) SetSerializer(serializer sersan.SessionSerializer) {
+	s.serializer = serializer
+}
+
+// Migrate creates or updates the sessions table to the latest schema. The applied
+// schema version is tracked in a table named after the sessions table with
+// `_migrations` suffix. Run it once at application start up.
+func (s *SQLStore) Migrate() error {
+	return s.MigrateContext(context.Background())
+}
+
+func (s *SQLStore) MigrateContext(ctx context.Context) error {
+	versionTable := s.table + "_migrations"
+	_, err := s.DB.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+versionTable+" (version INTEGER NOT NULL PRIMARY KEY)")
+	if err != nil {
+		return err
+	}
+
+	var version int
+	err = s.DB.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM "+versionTable).Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for ; version < len(migrations); version++ {
+		if err = s.migrate(ctx, versionTable, version+1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *SQLStore) migrate(ctx context.Context, versionTable string, version int) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range migrations[version-1](s.dialect, s.table) {
+		if _, err = tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("sersan/sql: migration %d failed: %v", version, err)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, s.dialect.rebind("INSERT INTO "+versionTable+" (version) VALUES (?)"), version)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLStore) Get(id string) (*sersan.Session, error) {
+	return s.GetContext(context.Background(), id)
+}
+
+func (s *SQLStore) GetContext(ctx context.Context, id string) (*sersan.Session, error) {
+	var (
+		authID                string
+		data                  []byte
+		createdAt, accessedAt int64
+		md                    sersan.Metadata
+		binding               string
+	)
+
+	row := s.DB.QueryRowContext(ctx, s.query("SELECT auth_id, data, created_at, accessed_at, ip, last_seen_ip, user_agent, label, binding FROM %s WHERE id = ?"), id)
+	err := row.Scan(&authID, &data, &createdAt, &accessedAt, &md.IP, &md.LastSeenIP, &md.UserAgent, &md.Label, &binding)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sess := sersan.NewSession(id, authID, time.Unix(0, createdAt).UTC())
+	sess.AccessedAt = time.Unix(0, accessedAt).UTC()
+	sess.Metadata = md
+	sess.Binding = binding
+	if err = s.serializer.Deserialize(data, sess); err != nil {
+		return nil, err
+	}
+
+	return sess, nil
+}
+
+func (s *SQLStore) Destroy(id string) error {
+	return s.DestroyContext(context.Background(), id)
+}
+
+func (s *SQLStore) DestroyContext(ctx context.Context, id string) error {
+	_, err := s.DB.ExecContext(ctx, s.query("DELETE FROM %s WHERE id = ?"), id)
+	return err
+}
+
+func (s *SQLStore) DestroyAllOfAuthId(authId string) error {
+	return s.DestroyAllOfAuthIdContext(context.Background(), authId)
+}
+
+func (s *SQLStore) DestroyAllOfAuthIdContext(ctx context.Context, authId string) error {
+	// anonymous sessions share the empty auth ID, never delete them all.
+	if authId == "" {
+		return nil
+	}
+
+	_, err := s.DB.ExecContext(ctx, s.query("DELETE FROM %s WHERE auth_id = ?"), authId)
+	return err
+}
+
+func (s *SQLStore) Insert(sess *sersan.Session) error {
+	return s.InsertContext(context.Background(), sess)
+}
+
+func (s *SQLStore) InsertContext(ctx context.Context, sess *sersan.Session) error {
+	data, err := s.serializer.Serialize(sess)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.DB.ExecContext(ctx,
+		s.query("INSERT INTO %s (id, auth_id, data, created_at, accessed_at, ip, last_seen_ip, user_agent, label, binding) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"),
+		sess.ID, sess.AuthID, data, sess.CreatedAt.UnixNano(), sess.AccessedAt.UnixNano(),
+		sess.Metadata.IP, sess.Metadata.LastSeenIP, sess.Metadata.UserAgent, sess.Metadata.Label, sess.Binding)
+	if s.dialect.isUniqueViolation(err) {
+		return sersan.SessionAlreadyExists{ID: sess.ID}
+	}
+
+	return err
+}
+
+func (s *SQLStore) Replace(sess *sersan.Session) error {
+	return s.ReplaceContext(context.Background(), sess)
+}
+
+func (s *SQLStore) ReplaceContext(ctx context.Context, sess *sersan.Session) error {
+	data, err := s.serializer.Serialize(sess)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.DB.ExecContext(ctx,
+		s.query("UPDATE %s SET auth_id = ?, data = ?, created_at = ?, accessed_at = ?, ip = ?, last_seen_ip = ?, user_agent = ?, label = ?, binding = ? WHERE id = ?"),
+		sess.AuthID, data, sess.CreatedAt.UnixNano(), sess.AccessedAt.UnixNano(),
+		sess.Metadata.IP, sess.Metadata.LastSeenIP, sess.Metadata.UserAgent, sess.Metadata.Label, sess.Binding, sess.ID)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	// MySQL reports the number of changed rows rather than matched ones, so zero
+	// doesn't necessarily mean the session is missing.
+	var exists int
+	err = s.DB.QueryRowContext(ctx, s.query("SELECT 1 FROM %s WHERE id = ?"), sess.ID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return sersan.SessionDoesNotExist{ID: sess.ID}
+	}
+
+	return err
+}
+
+// PurgeExpired deletes all sessions that are expired according to IdleTimeout and
+// AbsoluteTimeout, returns the number of deleted sessions. Nothing is deleted if
+// both timeouts are disabled.
+func (s *SQLStore) PurgeExpired() (int64, error) {
+	return s.PurgeExpiredContext(context.Background())
+}
+
+func (s *SQLStore) PurgeExpiredContext(ctx context.Context) (int64, error) {
+	var (
+		now   = time.Now().UTC()
+		conds []string
+		args  []interface{}
+	)
+
+	if s.IdleTimeout != 0 {
+		conds = append(conds, "accessed_at <= ?")
+		args = append(args, now.Add(-time.Duration(s.IdleTimeout)*time.Second).UnixNano())
+	}
+	if s.AbsoluteTimeout != 0 {
+		conds = append(conds, "created_at <= ?")
+		args = append(args, now.Add(-time.Duration(s.AbsoluteTimeout)*time.Second).UnixNano())
+	}
+	if len(conds) == 0 {
+		return 0, nil
+	}
+
+	where := conds[0]
+	if len(conds) == 2 {
+		where += " OR " + conds[1]
+	}
+
+	res, err := s.DB.ExecContext(ctx, s.query("DELETE FROM %s WHERE "+where), args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+func (s *SQLStore) query(q string) string {
+	return s.dialect.rebind(fmt.Sprintf(q, s.table))
+}
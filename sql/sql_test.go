@@ -0,0 +1,199 @@
+package sql
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/syaiful6/sersan"
+	"github.com/syaiful6/sersan/storagetest"
+)
+
+func createSQLStore(t *testing.T) *SQLStore {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "sessions.db"))
+	if err != nil {
+		t.Fatalf("can't open sqlite database: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	s, err := NewSQLStore(db, SQLite)
+	if err != nil {
+		t.Fatalf("can't create sqlstore, returned %v", err)
+	}
+	if err = s.Migrate(); err != nil {
+		t.Fatalf("Migrate returned error: %v", err)
+	}
+
+	return s
+}
+
+func TestMigrateTwice(t *testing.T) {
+	s := createSQLStore(t)
+	if err := s.Migrate(); err != nil {
+		t.Fatalf("Migrate must be idempotent, returned error: %v", err)
+	}
+
+	var version int
+	if err := s.DB.QueryRow("SELECT MAX(version) FROM sersan_sessions_migrations").Scan(&version); err != nil {
+		t.Fatalf("can't read schema version: %v", err)
+	}
+	if version != len(migrations) {
+		t.Fatalf("expected schema version %d, got %d", len(migrations), version)
+	}
+}
+
+func TestMigrateFromV1(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "sessions.db"))
+	if err != nil {
+		t.Fatalf("can't open sqlite database: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+
+	s, err := NewSQLStore(db, SQLite)
+	if err != nil {
+		t.Fatalf("can't create sqlstore, returned %v", err)
+	}
+
+	// session saved before the metadata columns were added
+	sess := storagetest.GenerateSession(true)
+	data, _ := s.serializer.Serialize(sess)
+	stmts := append(migrations[0](SQLite, s.table),
+		"CREATE TABLE sersan_sessions_migrations (version INTEGER NOT NULL PRIMARY KEY)",
+		"INSERT INTO sersan_sessions_migrations (version) VALUES (1)")
+	for _, stmt := range stmts {
+		if _, err = db.Exec(stmt); err != nil {
+			t.Fatalf("can't create version 1 schema: %v", err)
+		}
+	}
+	_, err = db.Exec("INSERT INTO sersan_sessions (id, auth_id, data, created_at, accessed_at) VALUES (?, ?, ?, ?, ?)",
+		sess.ID, sess.AuthID, data, sess.CreatedAt.UnixNano(), sess.AccessedAt.UnixNano())
+	if err != nil {
+		t.Fatalf("can't insert session: %v", err)
+	}
+
+	if err = s.Migrate(); err != nil {
+		t.Fatalf("Migrate returned error: %v", err)
+	}
+
+	gsess, err := s.Get(sess.ID)
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	storagetest.AssertSessionEqual(t, sess, gsess)
+	if gsess.Metadata != (sersan.Metadata{}) {
+		t.Fatalf("expected empty metadata for migrated session, got %+v", gsess.Metadata)
+	}
+}
+
+func TestReplaceUnchanged(t *testing.T) {
+	s := createSQLStore(t)
+	sess := storagetest.GenerateSession(true)
+	if err := s.Insert(sess); err != nil {
+		t.Fatalf("Failed inserting session. return %v", err)
+	}
+
+	// replacing with the same content may not change any rows, the session still
+	// exists
+	for i := 0; i < 2; i++ {
+		if err := s.Replace(sess); err != nil {
+			t.Fatalf("Replace returned error: %v", err)
+		}
+	}
+
+	gsess, _ := s.Get(sess.ID)
+	storagetest.AssertSessionEqual(t, sess, gsess)
+}
+
+func TestDestroyAllOfEmptyAuthId(t *testing.T) {
+	s := createSQLStore(t)
+	anonymous := storagetest.GenerateSession(false)
+	if err := s.Insert(anonymous); err != nil {
+		t.Fatalf("Insert returned error: %v", err)
+	}
+
+	if err := s.DestroyAllOfAuthId(""); err != nil {
+		t.Fatalf("DestroyAllOfAuthId returned error: %v", err)
+	}
+	if gsess, _ := s.Get(anonymous.ID); gsess == nil {
+		t.Fatal("anonymous sessions must not be deleted by DestroyAllOfAuthId")
+	}
+}
+
+func TestPurgeExpired(t *testing.T) {
+	s := createSQLStore(t)
+	s.IdleTimeout = 60
+	s.AbsoluteTimeout = 3600
+
+	idle := storagetest.GenerateSession(false)
+	idle.AccessedAt = idle.AccessedAt.Add(-2 * time.Minute)
+	absolute := storagetest.GenerateSession(false)
+	absolute.CreatedAt = absolute.CreatedAt.Add(-2 * time.Hour)
+	fresh := storagetest.GenerateSession(false)
+
+	for _, sess := range []*sersan.Session{idle, absolute, fresh} {
+		if err := s.Insert(sess); err != nil {
+			t.Fatalf("Insert returned error: %v", err)
+		}
+	}
+
+	n, err := s.PurgeExpired()
+	if err != nil {
+		t.Fatalf("PurgeExpired returned error: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("expected PurgeExpired to delete 2 sessions, deleted %d", n)
+	}
+	if gsess, _ := s.Get(fresh.ID); gsess == nil {
+		t.Fatal("fresh session must not be purged")
+	}
+}
+
+func TestRebind(t *testing.T) {
+	q := "UPDATE t SET a = ?, b = ? WHERE id = ?"
+	if r := PostgreSQL.rebind(q); r != "UPDATE t SET a = $1, b = $2 WHERE id = $3" {
+		t.Fatalf("unexpected postgresql query: %s", r)
+	}
+	if r := MySQL.rebind(q); r != q {
+		t.Fatalf("unexpected mysql query: %s", r)
+	}
+}
+
+// error of a driver exposing the SQLSTATE
+type sqlStateError string
+
+func (e sqlStateError) Error() string    { return "driver error" }
+func (e sqlStateError) SQLState() string { return string(e) }
+
+func TestIsUniqueViolation(t *testing.T) {
+	tests := []struct {
+		d        Dialect
+		err      error
+		expected bool
+	}{
+		{PostgreSQL, sqlStateError("23505"), true},
+		{PostgreSQL, fmt.Errorf("insert failed: %w", sqlStateError("23505")), true},
+		{PostgreSQL, fmt.Errorf("insert failed: %w", sqlStateError("23503")), false},
+		{MySQL, fmt.Errorf("insert failed: %w", errors.New("Error 1062: Duplicate entry")), true},
+		{SQLite, fmt.Errorf("insert failed: %w", errors.New("UNIQUE constraint failed: sessions.id")), true},
+		{SQLite, errors.New("database is locked"), false},
+		{PostgreSQL, nil, false},
+	}
+	for _, test := range tests {
+		if r := test.d.isUniqueViolation(test.err); r != test.expected {
+			t.Errorf("expected isUniqueViolation of %v to be %v, got %v", test.err, test.expected, r)
+		}
+	}
+}
+
+func TestStorageSuite(t *testing.T) {
+	storagetest.RunStorageSuite(t, func(t *testing.T) sersan.Storage {
+		return createSQLStore(t)
+	})
+}
@@ -1,5 +1,10 @@
 package sersan
 
+import (
+	"context"
+	"time"
+)
+
 // A storage backend, for server-side sessions.
 type Storage interface {
 	// Get the session for the given session ID. Returns nil if it not exists
@@ -20,23 +25,285 @@ type Storage interface {
 	Replace(sess *Session) error
 }
 
+// StorageContext is the context-aware variant of Storage. The semantics of each
+// method are the same as its Storage counterpart, but implementations should
+// abort and return the context's error when ctx is canceled or its deadline
+// is exceeded.
+type StorageContext interface {
+	GetContext(ctx context.Context, id string) (*Session, error)
+	DestroyContext(ctx context.Context, id string) error
+	DestroyAllOfAuthIdContext(ctx context.Context, authId string) error
+	InsertContext(ctx context.Context, sess *Session) error
+	ReplaceContext(ctx context.Context, sess *Session) error
+}
+
+// Toucher is an optional extension to Storage, for storages that can update the
+// access time of a session without rewriting the whole session. ServerSessionState
+// uses it to refresh the idle timeout of sessions whose data is unmodified.
+type Toucher interface {
+	// Set the AccessedAt of the session to accessedAt and expire it after expire
+	// seconds, zero means the storage's default. Return 'SessionDoesNotExist' if
+	// there is no session with the given session ID.
+	Touch(id string, accessedAt time.Time, expire int) error
+}
+
+// ToucherContext is the context-aware variant of Toucher. ServerSessionState uses it
+// instead of Toucher when the storage implements both.
+type ToucherContext interface {
+	TouchContext(ctx context.Context, id string, accessedAt time.Time, expire int) error
+}
+
+// AuthIndex is an optional extension to Storage, for storages that can enumerate
+// the sessions of a given auth ID. It's used to build "active devices" pages.
+type AuthIndex interface {
+	// List the sessions of the given auth ID, in no particular order. Returns an
+	// empty list if there are no sessions of the given auth ID.
+	ListByAuthId(authId string) ([]*Session, error)
+	// Delete all sessions of the given auth ID, except the session with the given
+	// session ID.
+	DestroyByAuthIdExcept(authId, keepId string) error
+}
+
+// AuthIndexContext is the context-aware variant of AuthIndex. ServerSessionState
+// uses it instead of AuthIndex when the storage implements both.
+type AuthIndexContext interface {
+	ListByAuthIdContext(ctx context.Context, authId string) ([]*Session, error)
+	DestroyByAuthIdExceptContext(ctx context.Context, authId, keepId string) error
+}
+
+// VersionReplacer is an optional extension to Storage, for storages that can
+// replace a session atomically only if it wasn't replaced since it was loaded.
+// ServerSessionState uses it to detect concurrent writes, see ConflictStrategy.
+type VersionReplacer interface {
+	// Replace the contents of a session, only if the stored session's Version is
+	// equal to version. Return 'SessionVersionConflict' if it's not, and
+	// 'SessionDoesNotExist' if there is no session with the given session ID.
+	ReplaceIfVersion(sess *Session, version int64) error
+}
+
+// VersionReplacerContext is the context-aware variant of VersionReplacer.
+// ServerSessionState uses it instead of VersionReplacer when the storage implements
+// both.
+type VersionReplacerContext interface {
+	ReplaceIfVersionContext(ctx context.Context, sess *Session, version int64) error
+}
+
+// SessionDelta holds the changes made to a session during a request, see
+// DeltaStorage.
+type SessionDelta struct {
+	// ID of the modified session
+	ID string
+	// Values added or updated
+	Updated map[interface{}]interface{}
+	// Keys of the values deleted
+	Deleted []interface{}
+	// The new AccessedAt, Metadata and Binding of the session
+	AccessedAt time.Time
+	Metadata   Metadata
+	Binding    string
+}
+
+// DeltaStorage is an optional extension to Storage, for storages that can apply the
+// changes made to the values of a session without rewriting the others. It's used
+// by ServerSessionState when DeltaSave is enabled, so concurrent requests modifying
+// different keys don't overwrite each other's changes.
+type DeltaStorage interface {
+	// Apply the delta to the session with the session ID delta.ID, increment its
+	// Version and expire it after expire seconds, zero means the storage's default.
+	// The values not in the delta are left untouched. Return 'SessionDoesNotExist'
+	// if there is no session with the given session ID.
+	ApplyDelta(delta *SessionDelta, expire int) error
+}
+
+// DeltaStorageContext is the context-aware variant of DeltaStorage.
+// ServerSessionState uses it instead of DeltaStorage when the storage implements
+// both.
+type DeltaStorageContext interface {
+	ApplyDeltaContext(ctx context.Context, delta *SessionDelta, expire int) error
+}
+
+// Aliaser is an optional extension to Storage, for storages that can keep a short
+// lived alias of a session. ServerSessionState uses it to keep the old session ID
+// of a rotated session usable for a grace period.
+type Aliaser interface {
+	// Destroy the session with the given session ID, and make that ID an alias of
+	// the session with the session ID targetId for ttl seconds. Get still returns
+	// nil for an alias. Return 'SessionDoesNotExist', without creating the alias,
+	// if there is no session with the given session ID, e.g. it's already an alias.
+	Alias(id, targetId string, ttl int) error
+	// Returns the session ID the given session ID is an alias of, or an empty string
+	// if it's not an alias or the alias expired.
+	ResolveAlias(id string) (string, error)
+}
+
+// AliaserContext is the context-aware variant of Aliaser. ServerSessionState uses it
+// instead of Aliaser when the storage implements both.
+type AliaserContext interface {
+	AliasContext(ctx context.Context, id, targetId string, ttl int) error
+	ResolveAliasContext(ctx context.Context, id string) (string, error)
+}
+
+// WithContext returns a StorageContext for the given storage. If the storage
+// already implements StorageContext it is returned as is, otherwise it's wrapped
+// in an adapter that checks the context before delegating to the storage.
+func WithContext(s Storage) StorageContext {
+	if sc, ok := s.(StorageContext); ok {
+		return sc
+	}
+	return storageAdapter{s}
+}
+
+type storageAdapter struct {
+	s Storage
+}
+
+func (a storageAdapter) GetContext(ctx context.Context, id string) (*Session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.s.Get(id)
+}
+
+func (a storageAdapter) DestroyContext(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.s.Destroy(id)
+}
+
+func (a storageAdapter) DestroyAllOfAuthIdContext(ctx context.Context, authId string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.s.DestroyAllOfAuthId(authId)
+}
+
+func (a storageAdapter) InsertContext(ctx context.Context, sess *Session) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.s.Insert(sess)
+}
+
+func (a storageAdapter) ReplaceContext(ctx context.Context, sess *Session) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.s.Replace(sess)
+}
+
+// Calls TouchContext if the storage implements ToucherContext, otherwise checks the
+// context before calling Touch.
+func touchContext(ctx context.Context, t Toucher, id string, accessedAt time.Time, expire int) error {
+	if tc, ok := t.(ToucherContext); ok {
+		return tc.TouchContext(ctx, id, accessedAt, expire)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return t.Touch(id, accessedAt, expire)
+}
+
+// Calls ListByAuthIdContext if the storage implements AuthIndexContext, otherwise
+// checks the context before calling ListByAuthId.
+func listByAuthIdContext(ctx context.Context, index AuthIndex, authId string) ([]*Session, error) {
+	if ic, ok := index.(AuthIndexContext); ok {
+		return ic.ListByAuthIdContext(ctx, authId)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return index.ListByAuthId(authId)
+}
+
+// Calls DestroyByAuthIdExceptContext if the storage implements AuthIndexContext,
+// otherwise checks the context before calling DestroyByAuthIdExcept.
+func destroyByAuthIdExceptContext(ctx context.Context, index AuthIndex, authId, keepId string) error {
+	if ic, ok := index.(AuthIndexContext); ok {
+		return ic.DestroyByAuthIdExceptContext(ctx, authId, keepId)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return index.DestroyByAuthIdExcept(authId, keepId)
+}
+
+// Calls ReplaceIfVersionContext if the storage implements VersionReplacerContext,
+// otherwise checks the context before calling ReplaceIfVersion.
+func replaceIfVersionContext(ctx context.Context, r VersionReplacer, sess *Session, version int64) error {
+	if rc, ok := r.(VersionReplacerContext); ok {
+		return rc.ReplaceIfVersionContext(ctx, sess, version)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return r.ReplaceIfVersion(sess, version)
+}
+
+// Calls ApplyDeltaContext if the storage implements DeltaStorageContext, otherwise
+// checks the context before calling ApplyDelta.
+func applyDeltaContext(ctx context.Context, d DeltaStorage, delta *SessionDelta, expire int) error {
+	if dc, ok := d.(DeltaStorageContext); ok {
+		return dc.ApplyDeltaContext(ctx, delta, expire)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.ApplyDelta(delta, expire)
+}
+
+// Calls AliasContext if the storage implements AliaserContext, otherwise checks the
+// context before calling Alias.
+func aliasContext(ctx context.Context, a Aliaser, id, targetId string, ttl int) error {
+	if ac, ok := a.(AliaserContext); ok {
+		return ac.AliasContext(ctx, id, targetId, ttl)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.Alias(id, targetId, ttl)
+}
+
+// Calls ResolveAliasContext if the storage implements AliaserContext, otherwise
+// checks the context before calling ResolveAlias.
+func resolveAliasContext(ctx context.Context, a Aliaser, id string) (string, error) {
+	if ac, ok := a.(AliaserContext); ok {
+		return ac.ResolveAliasContext(ctx, id)
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return a.ResolveAlias(id)
+}
+
 // Operation item in StorageRecorder, represent mock operation that was executed.
 type RecorderOperation struct {
 	Tag, ID, AuthID string
 	Session         *Session
+	// session ID targeted by an alias
+	Target string
+	// delta applied to a session
+	Delta *SessionDelta
 }
 
 // Storage recorder implements sersan's storage interface that record all operations
 // performed. This is intended for testing purpose.
 type StorageRecorder struct {
 	sessions   map[string]*Session
+	aliases    map[string]recorderAlias
 	operations []*RecorderOperation
 }
 
+type recorderAlias struct {
+	target  string
+	expires time.Time
+}
+
 // NewRecorder returns an empty StorageRecorder
 func NewStorageRecorder() *StorageRecorder {
 	return &StorageRecorder{
 		sessions:   make(map[string]*Session),
+		aliases:    make(map[string]recorderAlias),
 		operations: []*RecorderOperation{},
 	}
 }
@@ -50,6 +317,7 @@ func PrepareStorageRecorder(sessions []*Session) *StorageRecorder {
 
 	return &StorageRecorder{
 		sessions:   sess,
+		aliases:    make(map[string]recorderAlias),
 		operations: []*RecorderOperation{},
 	}
 }
@@ -105,6 +373,104 @@ func (s *StorageRecorder) Replace(sess *Session) error {
 	return SessionDoesNotExist{ID: sess.ID}
 }
 
+func (s *StorageRecorder) Touch(id string, accessedAt time.Time, expire int) error {
+	s.operations = append(s.operations, &RecorderOperation{Tag: "Touch", ID: id})
+	if v, ok := s.sessions[id]; ok {
+		nsess := *v
+		nsess.AccessedAt = accessedAt
+		s.sessions[id] = &nsess
+		return nil
+	}
+
+	return SessionDoesNotExist{ID: id}
+}
+
+func (s *StorageRecorder) ListByAuthId(authId string) ([]*Session, error) {
+	s.operations = append(s.operations, &RecorderOperation{Tag: "ListByAuthId", AuthID: authId})
+	sessions := []*Session{}
+	for _, sess := range s.sessions {
+		if sess.AuthID == authId {
+			sessions = append(sessions, sess)
+		}
+	}
+
+	return sessions, nil
+}
+
+func (s *StorageRecorder) DestroyByAuthIdExcept(authId, keepId string) error {
+	nmap := make(map[string]*Session)
+	for k, sess := range s.sessions {
+		if sess.AuthID != authId || k == keepId {
+			nmap[k] = sess
+		}
+	}
+	s.sessions = nmap
+	s.operations = append(s.operations, &RecorderOperation{Tag: "DestroyByAuthIdExcept", ID: keepId, AuthID: authId})
+
+	return nil
+}
+
+func (s *StorageRecorder) ReplaceIfVersion(sess *Session, version int64) error {
+	s.operations = append(s.operations, &RecorderOperation{Tag: "ReplaceIfVersion", Session: sess})
+	v, ok := s.sessions[sess.ID]
+	if !ok {
+		return SessionDoesNotExist{ID: sess.ID}
+	}
+	if v.Version != version {
+		return SessionVersionConflict{ID: sess.ID}
+	}
+
+	s.sessions[sess.ID] = sess
+	return nil
+}
+
+func (s *StorageRecorder) ApplyDelta(delta *SessionDelta, expire int) error {
+	s.operations = append(s.operations, &RecorderOperation{Tag: "ApplyDelta", ID: delta.ID, Delta: delta})
+	v, ok := s.sessions[delta.ID]
+	if !ok {
+		return SessionDoesNotExist{ID: delta.ID}
+	}
+
+	nsess := *v
+	nsess.Values = make(map[interface{}]interface{}, len(v.Values))
+	for k, val := range v.Values {
+		nsess.Values[k] = val
+	}
+	for k, val := range delta.Updated {
+		nsess.Values[k] = val
+	}
+	for _, k := range delta.Deleted {
+		delete(nsess.Values, k)
+	}
+	nsess.AccessedAt = delta.AccessedAt
+	nsess.Metadata = delta.Metadata
+	nsess.Binding = delta.Binding
+	nsess.Version++
+	s.sessions[delta.ID] = &nsess
+
+	return nil
+}
+
+func (s *StorageRecorder) Alias(id, targetId string, ttl int) error {
+	s.operations = append(s.operations, &RecorderOperation{Tag: "Alias", ID: id, Target: targetId})
+	if _, ok := s.sessions[id]; !ok {
+		return SessionDoesNotExist{ID: id}
+	}
+
+	delete(s.sessions, id)
+	s.aliases[id] = recorderAlias{target: targetId, expires: time.Now().Add(time.Duration(ttl) * time.Second)}
+	return nil
+}
+
+func (s *StorageRecorder) ResolveAlias(id string) (string, error) {
+	s.operations = append(s.operations, &RecorderOperation{Tag: "ResolveAlias", ID: id})
+	if alias, ok := s.aliases[id]; ok && time.Now().Before(alias.expires) {
+		return alias.target, nil
+	}
+
+	return "", nil
+}
+
 // Get list of Operations performed in StorageRecorder, remove it from the storage
 // before returned.
 func (s *StorageRecorder) GetOperations() []*RecorderOperation {
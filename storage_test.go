@@ -1,6 +1,7 @@
 package sersan
 
 import (
+	"context"
 	"encoding/base32"
 	"math/rand"
 	"reflect"
@@ -110,3 +111,27 @@ func TestGetDestroyInsertOp(t *testing.T) {
 		t.Errorf("Expected nil returned in empty storage. return session ID %s instead", s.ID)
 	}
 }
+
+func TestWithContextCanceled(t *testing.T) {
+	storage := NewStorageRecorder()
+	sc := WithContext(storage)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	s := generateSession(true)
+	if err := sc.InsertContext(ctx, s); err != context.Canceled {
+		t.Fatalf("expected InsertContext to return context.Canceled, returned %v", err)
+	}
+	if operations := storage.GetOperations(); len(operations) != 0 {
+		t.Fatalf("storage must not be called with canceled context, got %d operations", len(operations))
+	}
+
+	if err := sc.InsertContext(context.Background(), s); err != nil {
+		t.Fatalf("InsertContext returned error: %v", err)
+	}
+	s1, err := sc.GetContext(context.Background(), s.ID)
+	if err != nil || !reflect.DeepEqual(s, s1) {
+		t.Fatalf("expected GetContext to return inserted session, returned error %v", err)
+	}
+}
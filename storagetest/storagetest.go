@@ -0,0 +1,364 @@
+/*
+Package storagetest provides a conformance test suite for sersan.Storage
+implementations. Every storage backend should pass it:
+
+	func TestStorage(t *testing.T) {
+		storagetest.RunStorageSuite(t, func(t *testing.T) sersan.Storage {
+			return NewMyStorage()
+		})
+	}
+
+The suite only uses string keys and values in Session.Values, so backends using
+JSON serialization can run it too.
+*/
+package storagetest
+
+import (
+	"encoding/base32"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+
+	"github.com/syaiful6/sersan"
+)
+
+// RunStorageSuite runs the conformance tests against the storage returned by
+// factory. factory is called once for every test; the storages it returns may
+// share the underlying data, the tests only use freshly generated IDs.
+func RunStorageSuite(t *testing.T, factory func(t *testing.T) sersan.Storage) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s sersan.Storage)
+	}{
+		{"GetNotExists", testGetNotExists},
+		{"InsertGet", testInsertGet},
+		{"InsertAlreadyExists", testInsertAlreadyExists},
+		{"ReplaceNotExists", testReplaceNotExists},
+		{"Replace", testReplace},
+		{"Destroy", testDestroy},
+		{"DestroyAllOfAuthId", testDestroyAllOfAuthId},
+		{"ReplaceAuthID", testReplaceAuthID},
+		{"Metadata", testMetadata},
+		{"Binding", testBinding},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.fn(t, factory(t))
+		})
+	}
+}
+
+func testGetNotExists(t *testing.T, s sersan.Storage) {
+	sess, err := s.Get(GenerateSessionId())
+	if err != nil || sess != nil {
+		t.Fatalf("Get of non existing session must return nil session and nil error, returned %v, %v", sess, err)
+	}
+}
+
+func testInsertGet(t *testing.T, s sersan.Storage) {
+	for _, sess := range []*sersan.Session{GenerateSession(false), GenerateSession(true)} {
+		mustInsert(t, s, sess)
+		assertStored(t, s, sess)
+	}
+
+	// session without values
+	sess := sersan.NewSession(GenerateSessionId(), "", time.Now().UTC())
+	mustInsert(t, s, sess)
+	assertStored(t, s, sess)
+}
+
+func testInsertAlreadyExists(t *testing.T, s sersan.Storage) {
+	s1 := GenerateSession(true)
+	s2 := GenerateSession(true)
+	s2.ID = s1.ID
+
+	mustInsert(t, s, s1)
+	err := s.Insert(s2)
+	if _, ok := err.(sersan.SessionAlreadyExists); !ok {
+		t.Fatalf("Inserting existing session ID must return SessionAlreadyExists, returned %v", err)
+	}
+
+	// the existing session must be kept intact
+	assertStored(t, s, s1)
+}
+
+func testReplaceNotExists(t *testing.T, s sersan.Storage) {
+	sess := GenerateSession(true)
+	err := s.Replace(sess)
+	if _, ok := err.(sersan.SessionDoesNotExist); !ok {
+		t.Fatalf("Replacing non existing session must return SessionDoesNotExist, returned %v", err)
+	}
+
+	assertNotStored(t, s, sess.ID)
+}
+
+func testReplace(t *testing.T, s sersan.Storage) {
+	sess := GenerateSession(true)
+	mustInsert(t, s, sess)
+
+	nsess := GenerateSession(true)
+	nsess.ID = sess.ID
+	nsess.CreatedAt = sess.CreatedAt
+	mustReplace(t, s, nsess)
+	assertStored(t, s, nsess)
+
+	// values removed from the session are removed from the storage
+	esess := CloneSession(nsess, nsess.AuthID)
+	esess.Values = make(map[interface{}]interface{})
+	mustReplace(t, s, esess)
+	assertStored(t, s, esess)
+}
+
+func testDestroy(t *testing.T, s sersan.Storage) {
+	if err := s.Destroy(GenerateSessionId()); err != nil {
+		t.Fatalf("Destroy of non existing session must not return error, returned %v", err)
+	}
+
+	sess := GenerateSession(true)
+	other := GenerateSession(true)
+	mustInsert(t, s, sess)
+	mustInsert(t, s, other)
+
+	if err := s.Destroy(sess.ID); err != nil {
+		t.Fatalf("Destroy returned error: %v", err)
+	}
+	assertNotStored(t, s, sess.ID)
+	assertStored(t, s, other)
+
+	// the ID can be used again
+	mustInsert(t, s, sess)
+	assertStored(t, s, sess)
+}
+
+func testDestroyAllOfAuthId(t *testing.T, s sersan.Storage) {
+	if err := s.DestroyAllOfAuthId(GenerateSessionId()); err != nil {
+		t.Fatalf("DestroyAllOfAuthId of non existing auth ID must not return error, returned %v", err)
+	}
+
+	master := GenerateSession(true)
+	authID := master.AuthID
+
+	slaves := make([]*sersan.Session, 10)
+	for i := range slaves {
+		slaves[i] = GenerateSession(false)
+		slaves[i].AuthID = authID
+	}
+	others := make([]*sersan.Session, 10)
+	for i := range others {
+		others[i] = GenerateSession(i%2 == 0)
+	}
+
+	mustInsert(t, s, master)
+	for _, sess := range append(slaves, others...) {
+		mustInsert(t, s, sess)
+	}
+
+	if err := s.DestroyAllOfAuthId(authID); err != nil {
+		t.Fatalf("DestroyAllOfAuthId returned error: %v", err)
+	}
+
+	for _, sess := range append(slaves, master) {
+		assertNotStored(t, s, sess.ID)
+	}
+	for _, sess := range others {
+		assertStored(t, s, sess)
+	}
+}
+
+// The auth ID of a session can be changed with Replace, the storage must keep
+// track of it.
+func testReplaceAuthID(t *testing.T, s sersan.Storage) {
+	authID := GenerateSessionId()
+
+	// no auth ID -> authID
+	anonymous := GenerateSession(false)
+	mustInsert(t, s, anonymous)
+	anonymous = CloneSession(anonymous, authID)
+	mustReplace(t, s, anonymous)
+
+	// another auth ID -> authID
+	moved := GenerateSession(true)
+	oldAuthID := moved.AuthID
+	mustInsert(t, s, moved)
+	moved = CloneSession(moved, authID)
+	mustReplace(t, s, moved)
+
+	// authID -> no auth ID
+	loggedOut := GenerateSession(false)
+	loggedOut.AuthID = authID
+	mustInsert(t, s, loggedOut)
+	loggedOut = CloneSession(loggedOut, "")
+	mustReplace(t, s, loggedOut)
+
+	for _, sess := range []*sersan.Session{anonymous, moved, loggedOut} {
+		assertStored(t, s, sess)
+	}
+
+	// old auth ID no longer owns the session
+	if err := s.DestroyAllOfAuthId(oldAuthID); err != nil {
+		t.Fatalf("DestroyAllOfAuthId returned error: %v", err)
+	}
+	assertStored(t, s, moved)
+
+	if err := s.DestroyAllOfAuthId(authID); err != nil {
+		t.Fatalf("DestroyAllOfAuthId returned error: %v", err)
+	}
+	assertNotStored(t, s, anonymous.ID)
+	assertNotStored(t, s, moved.ID)
+	assertStored(t, s, loggedOut)
+}
+
+func testMetadata(t *testing.T, s sersan.Storage) {
+	sess := GenerateSession(true)
+	sess.Metadata = sersan.Metadata{
+		IP:         "192.0.2.1",
+		LastSeenIP: "192.0.2.1",
+		UserAgent:  "Mozilla/5.0 (X11; Linux x86_64)",
+	}
+	mustInsert(t, s, sess)
+	assertMetadata(t, s, sess)
+
+	nsess := CloneSession(sess, sess.AuthID)
+	nsess.Metadata.LastSeenIP = "2001:db8::1"
+	nsess.Metadata.Label = "work laptop"
+	mustReplace(t, s, nsess)
+	assertMetadata(t, s, nsess)
+
+	// sessions without metadata
+	esess := GenerateSession(false)
+	mustInsert(t, s, esess)
+	assertMetadata(t, s, esess)
+}
+
+func testBinding(t *testing.T, s sersan.Storage) {
+	sess := GenerateSession(true)
+	sess.Binding = "ua:0123456789abcdef"
+	mustInsert(t, s, sess)
+	assertBinding(t, s, sess)
+
+	nsess := CloneSession(sess, sess.AuthID)
+	nsess.Binding = "ip:192.0.2.0/24"
+	mustReplace(t, s, nsess)
+	assertBinding(t, s, nsess)
+}
+
+func assertBinding(t *testing.T, s sersan.Storage, expected *sersan.Session) {
+	t.Helper()
+	assertStored(t, s, expected)
+
+	sess, _ := s.Get(expected.ID)
+	if sess.Binding != expected.Binding {
+		t.Fatalf("session binding saved and get not equal: %s == %s", expected.Binding, sess.Binding)
+	}
+}
+
+func assertMetadata(t *testing.T, s sersan.Storage, expected *sersan.Session) {
+	t.Helper()
+	assertStored(t, s, expected)
+
+	sess, _ := s.Get(expected.ID)
+	if sess.Metadata != expected.Metadata {
+		t.Fatalf("session metadata saved and get not equal: %+v == %+v", expected.Metadata, sess.Metadata)
+	}
+}
+
+func mustInsert(t *testing.T, s sersan.Storage, sess *sersan.Session) {
+	t.Helper()
+	if err := s.Insert(sess); err != nil {
+		t.Fatalf("Insert of session %s returned error: %v", sess.ID, err)
+	}
+}
+
+func mustReplace(t *testing.T, s sersan.Storage, sess *sersan.Session) {
+	t.Helper()
+	if err := s.Replace(sess); err != nil {
+		t.Fatalf("Replace of session %s returned error: %v", sess.ID, err)
+	}
+}
+
+func assertStored(t *testing.T, s sersan.Storage, expected *sersan.Session) {
+	t.Helper()
+	sess, err := s.Get(expected.ID)
+	if err != nil {
+		t.Fatalf("Get of session %s returned error: %v", expected.ID, err)
+	}
+	if sess == nil {
+		t.Fatalf("session %s must exist in the storage", expected.ID)
+	}
+
+	AssertSessionEqual(t, expected, sess)
+}
+
+// AssertSessionEqual fails the test if the session read from a storage isn't the
+// expected one. Storages may save the timestamps with lower precision, so they're
+// only compared to the second.
+func AssertSessionEqual(t *testing.T, expected, sess *sersan.Session) {
+	t.Helper()
+	if !expected.Equal(sess) || !timeEqual(expected.CreatedAt, sess.CreatedAt) || !timeEqual(expected.AccessedAt, sess.AccessedAt) {
+		t.Fatalf("session saved and get not equal. ID: %s == %s. AuthID: %s == %s, CreatedAt: %s == %s, AccessedAt: %s == %s. Values DeepEqual %v",
+			expected.ID, sess.ID, expected.AuthID, sess.AuthID,
+			expected.CreatedAt, sess.CreatedAt, expected.AccessedAt, sess.AccessedAt,
+			reflect.DeepEqual(expected.Values, sess.Values))
+	}
+}
+
+func assertNotStored(t *testing.T, s sersan.Storage, id string) {
+	t.Helper()
+	sess, err := s.Get(id)
+	if err != nil {
+		t.Fatalf("Get of session %s returned error: %v", id, err)
+	}
+	if sess != nil {
+		t.Fatalf("session %s must not exist in the storage", id)
+	}
+}
+
+func timeEqual(a, b time.Time) bool {
+	d := a.Sub(b)
+	return d < time.Second && d > -time.Second
+}
+
+// GenerateSessionId returns a random session ID.
+func GenerateSessionId() string {
+	return strings.TrimRight(
+		base32.StdEncoding.EncodeToString(
+			securecookie.GenerateRandomKey(32)), "=")
+}
+
+// GenerateSession returns a new session with random values, logged in with a
+// random auth ID if hasAuthID is true.
+func GenerateSession(hasAuthID bool) *sersan.Session {
+	id := GenerateSessionId()
+	authId := ""
+	if hasAuthID {
+		authId = GenerateSessionId()
+	}
+
+	sess := sersan.NewSession(id, authId, time.Now().UTC())
+	for i := 0; i < 20; i++ {
+		sess.Values[strconv.Itoa(rand.Int())] = strconv.Itoa(rand.Int())
+	}
+
+	return sess
+}
+
+// CloneSession returns a copy of the session with the given auth ID.
+func CloneSession(sess *sersan.Session, authID string) *sersan.Session {
+	nsess := sersan.NewSession(sess.ID, authID, sess.CreatedAt)
+	nsess.AccessedAt = sess.AccessedAt
+	nsess.Metadata = sess.Metadata
+	nsess.Binding = sess.Binding
+
+	for k, v := range sess.Values {
+		nsess.Values[k] = v
+	}
+
+	return nsess
+}
@@ -0,0 +1,13 @@
+package storagetest
+
+import (
+	"testing"
+
+	"github.com/syaiful6/sersan"
+)
+
+func TestStorageRecorder(t *testing.T) {
+	RunStorageSuite(t, func(t *testing.T) sersan.Storage {
+		return sersan.NewStorageRecorder()
+	})
+}